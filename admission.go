@@ -0,0 +1,116 @@
+package disklrucache
+
+import (
+	"hash/maphash"
+)
+
+// AdmissionFilter decides whether a new key enters a full cache, it is called under the cache lock
+type AdmissionFilter interface {
+	// a use of key, called by Get for hits and misses and by every commit
+	Record(key string)
+	// return true if the commit of candidate may evict victim, the entry evicted next
+	Admit(candidate string, victim string) bool
+}
+
+// FrequencyFilter admits a key used more often than the victim, like TinyLFU. The first use of a key
+// only sets it in a bloom filter called doorkeeper, so keys used once do not fill the sketch
+type FrequencyFilter struct {
+	sketch     *countMinSketch
+	doorkeeper []uint64
+	mask       uint64
+	seed       maphash.Seed
+}
+
+// width is the counters of each row of the sketch, about the keys expected, 0 is SKETCH_WIDTH
+func NewFrequencyFilter(width int) *FrequencyFilter {
+	if width <= 0 {
+		width = SKETCH_WIDTH
+	}
+	sketch := newCountMinSketch(width)
+	// 8 bits per key for the doorkeeper
+	bits := 8 * (sketch.mask + 1)
+	return &FrequencyFilter{sketch: sketch, doorkeeper: make([]uint64, bits/64), mask: bits - 1, seed: maphash.MakeSeed()}
+}
+
+// set the bits of key in doorkeeper, return true if they are all set already
+func (filter *FrequencyFilter) door(key string, set bool) bool {
+	hash := maphash.String(filter.seed, key)
+	found := true
+	for i := uint64(0); i < 3; i++ {
+		bit := (hash + i*(hash>>32|1)) & filter.mask
+		word, flag := bit/64, uint64(1)<<(bit%64)
+		if filter.doorkeeper[word]&flag == 0 {
+			found = false
+			if set {
+				filter.doorkeeper[word] |= flag
+			}
+		}
+	}
+	return found
+}
+
+func (filter *FrequencyFilter) Record(key string) {
+	if !filter.door(key, true) {
+		return
+	}
+	if filter.sketch.add(key) {
+		// the doorkeeper ages with the sketch
+		clear(filter.doorkeeper)
+	}
+}
+
+func (filter *FrequencyFilter) Estimate(key string) int {
+	freq := filter.sketch.estimate(key)
+	if filter.door(key, false) {
+		freq++
+	}
+	return freq
+}
+
+func (filter *FrequencyFilter) Admit(candidate string, victim string) bool {
+	return filter.Estimate(candidate) > filter.Estimate(victim)
+}
+
+// need lock manually
+func (cache *DiskLRUCache) recordUse(key string) {
+	if cache.admission != nil {
+		cache.admission.Record(key)
+	}
+}
+
+// return false if the commit of a new entry of size is kept out of the cache, need lock manually
+func (cache *DiskLRUCache) admit(key string, size int64) bool {
+	if cache.admission == nil || cache.curSize+size <= cache.maxSize && !cache.overMaxEntries(1) {
+		return true
+	}
+	victim := cache.peekVictim(key)
+	return victim == "" || cache.admission.Admit(key, victim)
+}
+
+// the key evicted next other than key, "" if none. need lock manually
+func (cache *DiskLRUCache) peekVictim(key string) string {
+	if cache.policy != nil {
+		victim, _ := cache.policy.Victim(cache.isPinned)
+		return victim
+	}
+	iterator := cache.entries.Iterator()
+	for iterator.Next() {
+		if entry := iterator.Value(); entry.readable && entry.pins == 0 && entry.key != key {
+			return entry.key
+		}
+	}
+	return ""
+}
+
+// drop the value of a new entry kept out by the admission filter, need lock manually
+func (editor *DiskLRUCacheEditor) reject() error {
+	editor.aborted = true
+	editor.removeTmpFiles()
+	editor.entry.curEditor = nil
+	editor.base.stats.rejections.Add(1)
+	err := editor.base.removeEntry(editor.entry.key, EVICT_REMOVED)
+	if err != nil || editor.base.discardNotAdmitted {
+		return err
+	}
+	return ErrNotAdmitted
+}
@@ -0,0 +1,125 @@
+package disklrucache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ARCPolicy is the adaptive replacement cache measured in bytes: entries used once are kept in t1,
+// entries used again in t2, and the keys evicted from them are remembered as ghosts in b1 and b2.
+// A commit of a ghost key moves the target size of t1 toward the list it was evicted from.
+// The target is saved with the list of each entry, the ghosts are not saved in the journal
+type ARCPolicy struct {
+	maxSize int64
+	target  int64 // bytes of t1 to keep, p of the paper
+	t1      policySegment
+	t2      policySegment
+	b1      policySegment
+	b2      policySegment
+}
+
+func NewARCPolicy() *ARCPolicy {
+	return &ARCPolicy{t1: newPolicySegment(), t2: newPolicySegment(), b1: newPolicySegment(), b2: newPolicySegment()}
+}
+
+func (policy *ARCPolicy) Name() string {
+	return "arc"
+}
+
+func (policy *ARCPolicy) SetMaxSize(maxSize int64) {
+	policy.maxSize = maxSize
+	policy.target = min(policy.target, maxSize)
+	policy.trimGhosts()
+}
+
+func (policy *ARCPolicy) OnInsert(key string, size int64) {
+	if policy.t1.del(key) >= 0 || policy.t2.del(key) >= 0 {
+		policy.t2.push(key, size)
+		return
+	}
+	if policy.b1.del(key) >= 0 {
+		// evicted from t1 too early, grow t1
+		policy.target = min(policy.target+adaptDelta(size, policy.b2.size, policy.b1.size), policy.maxSize)
+		policy.t2.push(key, size)
+	} else if policy.b2.del(key) >= 0 {
+		policy.target = max(policy.target-adaptDelta(size, policy.b1.size, policy.b2.size), 0)
+		policy.t2.push(key, size)
+	} else {
+		policy.t1.push(key, size)
+	}
+	policy.trimGhosts()
+}
+
+// size scaled by the ratio of the other ghost list, at least size
+func adaptDelta(size int64, other int64, hit int64) int64 {
+	if hit > 0 && other > hit {
+		return size * (other / hit)
+	}
+	return size
+}
+
+func (policy *ARCPolicy) OnAccess(key string) {
+	if size := policy.t1.del(key); size >= 0 {
+		policy.t2.push(key, size)
+	} else if size := policy.t2.del(key); size >= 0 {
+		policy.t2.push(key, size)
+	}
+}
+
+// the removed key is remembered as a ghost
+func (policy *ARCPolicy) OnRemove(key string) {
+	if size := policy.t1.del(key); size >= 0 {
+		policy.b1.push(key, size)
+	} else if size := policy.t2.del(key); size >= 0 {
+		policy.b2.push(key, size)
+	}
+	policy.trimGhosts()
+}
+
+func (policy *ARCPolicy) Victim(skip func(key string) bool) (string, bool) {
+	first, second := &policy.t2, &policy.t1
+	if policy.t1.len() > 0 && (policy.t1.size > policy.target || policy.t2.len() == 0) {
+		first, second = second, first
+	}
+	if key, ok := first.first(skip); ok {
+		return key, true
+	}
+	return second.first(skip)
+}
+
+// "list:target"
+func (policy *ARCPolicy) EntryState(key string) string {
+	list := "t1"
+	if policy.t2.has(key) {
+		list = "t2"
+	}
+	return fmt.Sprintf("%s:%d", list, policy.target)
+}
+
+// the most recently used entry is restored last, so its record has the latest target
+func (policy *ARCPolicy) RestoreEntry(key string, size int64, state string) {
+	policy.t1.del(key)
+	policy.t2.del(key)
+	list, target, _ := strings.Cut(state, ":")
+	if list == "t2" {
+		policy.t2.push(key, size)
+	} else {
+		policy.t1.push(key, size)
+	}
+	if target, err := strconv.ParseInt(target, 10, 64); err == nil {
+		policy.target = min(max(target, 0), policy.maxSize)
+	}
+}
+
+// keep t1+b1 within the max size and all lists within twice of it
+func (policy *ARCPolicy) trimGhosts() {
+	for policy.b1.len() > 0 && policy.t1.size+policy.b1.size > policy.maxSize {
+		key, _, _ := policy.b1.front()
+		policy.b1.del(key)
+	}
+	for policy.b2.len() > 0 && policy.t1.size+policy.t2.size+policy.b1.size+policy.b2.size > 2*policy.maxSize {
+		key, _, _ := policy.b2.front()
+		policy.b2.del(key)
+	}
+}
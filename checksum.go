@@ -0,0 +1,362 @@
+package disklrucache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math/bits"
+	"os"
+	"strings"
+)
+
+type ChecksumType int
+
+const (
+	CHECKSUM_NONE ChecksumType = iota
+	CHECKSUM_CRC32C
+	// 64 bits xxHash (XXH64) with seed 0
+	CHECKSUM_XXHASH
+	CHECKSUM_SHA256
+)
+
+func (checksum ChecksumType) String() string {
+	switch checksum {
+	case CHECKSUM_NONE:
+		return "none"
+	case CHECKSUM_CRC32C:
+		return "crc32c"
+	case CHECKSUM_XXHASH:
+		return "xxhash"
+	case CHECKSUM_SHA256:
+		return "sha256"
+	}
+	return "unknown"
+}
+
+func parseChecksumType(name string) (ChecksumType, bool) {
+	for checksum := CHECKSUM_CRC32C; checksum <= CHECKSUM_SHA256; checksum++ {
+		if checksum.String() == name {
+			return checksum, true
+		}
+	}
+	return CHECKSUM_NONE, false
+}
+
+func (checksum ChecksumType) newHash() hash.Hash {
+	switch checksum {
+	case CHECKSUM_CRC32C:
+		return crc32.New(crc32c)
+	case CHECKSUM_XXHASH:
+		return newXXHash64()
+	case CHECKSUM_SHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+// the checksum of each value saved in the clean record as "sum=type:hex,hex..."
+func (meta *entryMeta) sumAttr() string {
+	if meta.checksum == CHECKSUM_NONE || len(meta.sums) == 0 {
+		return ""
+	}
+	sums := make([]string, len(meta.sums))
+	for i, sum := range meta.sums {
+		sums[i] = hex.EncodeToString(sum)
+	}
+	return " " + ATTR_SUM + "=" + meta.checksum.String() + ":" + strings.Join(sums, ",")
+}
+
+func (meta *entryMeta) parseSumAttr(value string) error {
+	name, sums, ok := strings.Cut(value, ":")
+	if !ok {
+		return NewJournalFileFormatError()
+	}
+	checksum, ok := parseChecksumType(name)
+	if !ok {
+		// written by a newer version, the entry is not verified
+		return nil
+	}
+	meta.checksum = checksum
+	meta.sums = nil
+	for _, str := range strings.Split(sums, ",") {
+		sum, err := hex.DecodeString(str)
+		if err != nil {
+			return NewJournalFileFormatError()
+		}
+		meta.sums = append(meta.sums, sum)
+	}
+	return nil
+}
+
+// hash the file of a value written by random writes
+func fileChecksum(checksum ChecksumType, name string) ([]byte, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := checksum.newHash()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// hash the written values before Commit takes the cache lock.
+// a value written from the start by output or append streams is hashed while writing, others are read again
+func (editor *DiskLRUCacheEditor) sumValues() error {
+	checksum := editor.base.checksum
+	if checksum == CHECKSUM_NONE {
+		return nil
+	}
+	editor.sums = make([][]byte, len(editor.tmpFilenames))
+	for i, name := range editor.tmpFilenames {
+		if name == "" {
+			continue
+		}
+		if editor.hashes[i] != nil && editor.hashedSizes[i] == fileSize(name) {
+			editor.sums[i] = editor.hashes[i].Sum(nil)
+			continue
+		}
+		sum, err := fileChecksum(checksum, name)
+		if err != nil {
+			return err
+		}
+		editor.sums[i] = sum
+	}
+	return nil
+}
+
+// set the checksums of the commited values, values not written keep their sums, need lock manually
+func (editor *DiskLRUCacheEditor) commitSums() {
+	checksum := editor.base.checksum
+	if checksum == CHECKSUM_NONE {
+		return
+	}
+	old := editor.entry.meta
+	for i, sum := range editor.sums {
+		if sum != nil {
+			continue
+		}
+		if old.checksum != checksum || i >= len(old.sums) {
+			// the old value is written by other checksum, leave the entry unverified
+			return
+		}
+		editor.sums[i] = old.sums[i]
+	}
+	editor.meta.checksum = checksum
+	editor.meta.sums = editor.sums
+}
+
+// prepare the hash of a stream, random writes disable it until the value is truncated
+func (editor *DiskLRUCacheEditor) resetHash(index int, flag int) {
+	if editor.base.checksum == CHECKSUM_NONE {
+		return
+	}
+	if flag&os.O_TRUNC != 0 || flag&os.O_APPEND != 0 && editor.hashes[index] == nil && fileSize(editor.tmpFilenames[index]) == 0 {
+		editor.hashes[index] = editor.base.checksum.newHash()
+		editor.hashedSizes[index] = 0
+	} else if flag&os.O_APPEND == 0 {
+		editor.hashes[index] = nil
+	}
+}
+
+// VerifyingReader checks the checksum of a value when it is read to the end,
+// Seek back to the start restarts the check, other seeks and ReadAt skip it
+type VerifyingReader struct {
+	Reader
+	cache    *DiskLRUCache
+	key      string
+	index    int
+	commitId uint32
+	checksum ChecksumType
+	expected []byte
+	hash     hash.Hash
+	offset   int64
+	skip     bool
+}
+
+func (r *VerifyingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if !r.skip {
+		r.hash.Write(p[:n])
+		r.offset += int64(n)
+		if err == io.EOF && !bytes.Equal(r.hash.Sum(nil), r.expected) {
+			r.skip = true
+			r.cache.removeCorrupt(r.key, r.commitId)
+			return n, NewCorruptEntryError(r.key, r.index, r.checksum)
+		}
+	}
+	return n, err
+}
+
+func (r *VerifyingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.Reader.Seek(offset, whence)
+	if err == nil && pos != r.offset {
+		if pos == 0 {
+			r.hash.Reset()
+			r.offset = 0
+			r.skip = false
+		} else {
+			r.skip = true
+		}
+	}
+	return pos, err
+}
+
+func (r *VerifyingReader) ReadAt(p []byte, off int64) (int, error) {
+	r.skip = true
+	return r.Reader.ReadAt(p, off)
+}
+
+func (r *VerifyingReader) Name() string {
+	if named, ok := r.Reader.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return ""
+}
+
+// need lock manually
+func (cache *DiskLRUCache) newVerifyingReader(entry *CacheEntry, index int, reader Reader) Reader {
+	if entry.meta.checksum == CHECKSUM_NONE || index >= len(entry.meta.sums) {
+		return reader
+	}
+	return &VerifyingReader{
+		Reader:   reader,
+		cache:    cache,
+		key:      entry.key,
+		index:    index,
+		commitId: entry.commitId,
+		checksum: entry.meta.checksum,
+		expected: entry.meta.sums[index],
+		hash:     entry.meta.checksum.newHash(),
+	}
+}
+
+// remove the entry if its value is not replaced after the corrupt one is read
+func (cache *DiskLRUCache) removeCorrupt(key string, commitId uint32) {
+	cache.lock.Lock()
+	defer cache.unlockAndNotify()
+	entry := cache.entries.Peek(key)
+	if entry == nil || entry.commitId != commitId || cache.journalFile == nil {
+		return
+	}
+	cache.logger.Printf("warning: cache %s is corrupt, remove it", key)
+	cache.stats.corruptions.Add(1)
+	cache.removeEntry(key, EVICT_CORRUPT)
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxHash64 is the streaming XXH64 with seed 0
+type xxHash64 struct {
+	v     [4]uint64
+	total uint64
+	mem   [32]byte
+	n     int
+}
+
+func newXXHash64() *xxHash64 {
+	h := &xxHash64{}
+	h.Reset()
+	return h
+}
+
+func (h *xxHash64) Reset() {
+	// constants overflow, so the wrapping sums are computed on variables
+	prime1, prime2 := xxPrime1, xxPrime2
+	h.v = [4]uint64{prime1 + prime2, prime2, 0, -prime1}
+	h.total = 0
+	h.n = 0
+}
+
+func (h *xxHash64) Size() int {
+	return 8
+}
+
+func (h *xxHash64) BlockSize() int {
+	return 32
+}
+
+func xxRound(acc uint64, input uint64) uint64 {
+	acc += input * xxPrime2
+	return bits.RotateLeft64(acc, 31) * xxPrime1
+}
+
+func xxMergeRound(acc uint64, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func (h *xxHash64) block(b []byte) {
+	for i := range h.v {
+		h.v[i] = xxRound(h.v[i], binary.LittleEndian.Uint64(b[i*8:]))
+	}
+}
+
+func (h *xxHash64) Write(b []byte) (int, error) {
+	n := len(b)
+	h.total += uint64(n)
+	if h.n+len(b) < 32 {
+		h.n += copy(h.mem[h.n:], b)
+		return n, nil
+	}
+	if h.n > 0 {
+		b = b[copy(h.mem[h.n:], b):]
+		h.block(h.mem[:])
+		h.n = 0
+	}
+	for ; len(b) >= 32; b = b[32:] {
+		h.block(b)
+	}
+	h.n = copy(h.mem[:], b)
+	return n, nil
+}
+
+func (h *xxHash64) Sum64() uint64 {
+	var acc uint64
+	if h.total >= 32 {
+		v := h.v
+		acc = bits.RotateLeft64(v[0], 1) + bits.RotateLeft64(v[1], 7) + bits.RotateLeft64(v[2], 12) + bits.RotateLeft64(v[3], 18)
+		for _, lane := range v {
+			acc = xxMergeRound(acc, lane)
+		}
+	} else {
+		acc = xxPrime5
+	}
+	acc += h.total
+	b := h.mem[:h.n]
+	for ; len(b) >= 8; b = b[8:] {
+		acc ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		acc = bits.RotateLeft64(acc, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		acc = bits.RotateLeft64(acc, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		acc ^= uint64(c) * xxPrime5
+		acc = bits.RotateLeft64(acc, 11) * xxPrime1
+	}
+	acc ^= acc >> 33
+	acc *= xxPrime2
+	acc ^= acc >> 29
+	acc *= xxPrime3
+	acc ^= acc >> 32
+	return acc
+}
+
+func (h *xxHash64) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, h.Sum64())
+}
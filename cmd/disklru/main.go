@@ -0,0 +1,447 @@
+// Command disklru inspects and operates a cache directory of go-disklrucache.
+//
+//	disklru [-app N] [-version N] [-checksum ALG] <command> [flags] <dir> [args]
+//
+// The value count, shard levels, key mapper, journal format and max size are read from the journal,
+// the app and cache versions are checked against -app and -version when they are given.
+// ls, get, stats and verify without -repair open the cache read-only, so they work while an application
+// has it opened.
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	disklrucache "github.com/ashesofdream/go-disklrucache"
+)
+
+const timeLayout = "2006-01-02 15:04:05.000"
+
+var checksums = map[string]disklrucache.ChecksumType{
+	"none":   disklrucache.CHECKSUM_NONE,
+	"crc32c": disklrucache.CHECKSUM_CRC32C,
+	"xxhash": disklrucache.CHECKSUM_XXHASH,
+	"sha256": disklrucache.CHECKSUM_SHA256,
+}
+
+var (
+	// errors already printed, only the exit code is left
+	errFailed = errors.New("failed")
+	// wrong arguments of a command, its usage is printed
+	errUsage = errors.New("usage")
+)
+
+type command struct {
+	usage string
+	run   func(cli *cli, flags *flag.FlagSet, args []string) error
+	// define the flags of the command into cli
+	flags func(cli *cli, flags *flag.FlagSet)
+}
+
+var commands = map[string]command{
+	"ls":           {usage: "ls <dir>", run: runLs},
+	"get":          {usage: "get [-index N] <dir> <key>", run: runGet, flags: getFlags},
+	"put":          {usage: "put [-ttl D] [-cost N] <dir> <key> [file...]", run: runPut, flags: putFlags},
+	"rm":           {usage: "rm <dir> <key>...", run: runRm},
+	"stats":        {usage: "stats <dir>", run: runStats},
+	"compact":      {usage: "compact <dir>", run: runCompact},
+	"verify":       {usage: "verify [-checksums] [-repair] <dir>", run: runVerify, flags: verifyFlags},
+	"dump-journal": {usage: "dump-journal <dir>", run: runDumpJournal},
+}
+
+type cli struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	appVersion   int
+	cacheVersion int
+	checksum     disklrucache.ChecksumType
+	valueCount   int // read from the journal by open
+
+	// flags of commands
+	index           int
+	ttl             time.Duration
+	cost            float64
+	verifyChecksums bool
+	repair          bool
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// return the exit code, 2 for bad usage
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+	global := flag.NewFlagSet("disklru", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	global.IntVar(&c.appVersion, "app", -1, "app version of the cache, default is the one in journal")
+	global.IntVar(&c.cacheVersion, "version", -1, "cache version of the cache, default is the one in journal")
+	checksum := global.String("checksum", "none", "checksum of values written by put: none, crc32c, xxhash or sha256")
+	global.Usage = func() {
+		fmt.Fprintf(stderr, "usage: disklru [flags] <command> [flags] <dir> [args]\n\ncommands:\n")
+		for _, name := range []string{"ls", "get", "put", "rm", "stats", "compact", "verify", "dump-journal"} {
+			fmt.Fprintf(stderr, "  %s\n", commands[name].usage)
+		}
+		fmt.Fprintf(stderr, "\nflags:\n")
+		global.PrintDefaults()
+	}
+	if err := global.Parse(args); err != nil {
+		return 2
+	}
+	var ok bool
+	if c.checksum, ok = checksums[*checksum]; !ok {
+		fmt.Fprintf(stderr, "disklru: unknown checksum %q\n", *checksum)
+		return 2
+	}
+	if global.NArg() == 0 {
+		global.Usage()
+		return 2
+	}
+	cmd, ok := commands[global.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "disklru: unknown command %q\n", global.Arg(0))
+		global.Usage()
+		return 2
+	}
+	flags := flag.NewFlagSet(global.Arg(0), flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: disklru %s\n", cmd.usage)
+		flags.PrintDefaults()
+	}
+	if cmd.flags != nil {
+		cmd.flags(c, flags)
+	}
+	if err := flags.Parse(global.Args()[1:]); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	if err := cmd.run(c, flags, flags.Args()); err != nil {
+		if err == errUsage {
+			flags.Usage()
+			return 2
+		}
+		if err != errFailed {
+			fmt.Fprintf(stderr, "disklru: %s\n", err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// open the cache with the options saved in its journal
+func (c *cli) open(dir string, readOnly bool) (*disklrucache.DiskLRUCache, error) {
+	scanner, err := disklrucache.OpenJournal(dir)
+	if err != nil {
+		return nil, err
+	}
+	header := scanner.Header()
+	scanner.Close()
+	c.valueCount = header.ValueCount
+	opts := disklrucache.Options{
+		AppVersion:    header.AppVersion,
+		CacheVersion:  header.CacheVersion,
+		MaxSize:       header.MaxSize,
+		MaxEntries:    header.MaxEntries,
+		ValueCount:    header.ValueCount,
+		ShardLevels:   header.ShardLevels,
+		JournalFormat: header.Format,
+		Checksum:      c.checksum,
+		Logger:        log.New(c.stderr, "disklru: ", 0),
+		ReadOnly:      readOnly,
+	}
+	if c.appVersion >= 0 {
+		opts.AppVersion = c.appVersion
+	}
+	if c.cacheVersion >= 0 {
+		opts.CacheVersion = c.cacheVersion
+	}
+	switch header.KeyMapper {
+	case disklrucache.EscapeKeyMapper{}.Name(), disklrucache.LEGACY_KEY_MAPPER:
+		// a legacy cache is read as it is, a writer migrates it to the default mapper
+		opts.KeyMapper = disklrucache.EscapeKeyMapper{}
+	case disklrucache.HashKeyMapper{}.Name():
+		opts.KeyMapper = disklrucache.HashKeyMapper{}
+	default:
+		return nil, fmt.Errorf("unknown key mapper %q", header.KeyMapper)
+	}
+	// a writer keeps the policy of the journal, the states of another one would be dropped
+	switch header.Policy {
+	case "":
+	case "lru":
+		opts.EvictionPolicy = disklrucache.NewLRUPolicy()
+	case "lfu":
+		opts.EvictionPolicy = disklrucache.NewLFUPolicy()
+	case "slru":
+		opts.EvictionPolicy = disklrucache.NewSLRUPolicy(0)
+	case "arc":
+		opts.EvictionPolicy = disklrucache.NewARCPolicy()
+	case "tinylfu":
+		opts.EvictionPolicy = disklrucache.NewTinyLFUPolicy(0)
+	case "gds":
+		opts.EvictionPolicy = disklrucache.NewGreedyDualSizePolicy()
+	default:
+		if !readOnly {
+			return nil, fmt.Errorf("unknown eviction policy %q", header.Policy)
+		}
+	}
+	return disklrucache.Open(dir, opts)
+}
+
+// open the cache in args[0], run fn and close the cache
+func (c *cli) withCache(args []string, readOnly bool, fn func(cache *disklrucache.DiskLRUCache) error) error {
+	cache, err := c.open(args[0], readOnly)
+	if err != nil {
+		return err
+	}
+	err = fn(cache)
+	if closeErr := cache.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(timeLayout)
+}
+
+func runLs(c *cli, flags *flag.FlagSet, args []string) error {
+	return c.withCache(args, true, func(cache *disklrucache.DiskLRUCache) error {
+		w := tabwriter.NewWriter(c.stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tSIZE\tTIME\tEXPIRY\tSTATE")
+		for _, entry := range cache.Entries() {
+			state := "clean"
+			if !entry.Readable {
+				state = "dirty"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", entry.Key, entry.Size, formatTime(entry.Time), formatTime(entry.Expiry), state)
+		}
+		return w.Flush()
+	})
+}
+
+func getFlags(c *cli, flags *flag.FlagSet) {
+	flags.IntVar(&c.index, "index", 0, "index of the value to print")
+}
+
+func runGet(c *cli, flags *flag.FlagSet, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	return c.withCache(args, true, func(cache *disklrucache.DiskLRUCache) error {
+		if c.index < 0 || c.index >= c.valueCount {
+			return fmt.Errorf("value index %d out of range [0,%d)", c.index, c.valueCount)
+		}
+		snapshot, err := cache.Get(args[1])
+		if err != nil {
+			return err
+		}
+		if snapshot == nil {
+			return fmt.Errorf("key %q not found", args[1])
+		}
+		defer snapshot.Close()
+		_, err = io.Copy(c.stdout, snapshot.GetReader(c.index))
+		return err
+	})
+}
+
+func putFlags(c *cli, flags *flag.FlagSet) {
+	flags.DurationVar(&c.ttl, "ttl", 0, "expire the entry after ttl, 0 never expires")
+	flags.Float64Var(&c.cost, "cost", 0, "cost to produce the value again, weighed by the gds policy")
+}
+
+func runPut(c *cli, flags *flag.FlagSet, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	files := args[2:]
+	return c.withCache(args, false, func(cache *disklrucache.DiskLRUCache) error {
+		editor, err := cache.TryEdit(args[1])
+		if err != nil {
+			return err
+		}
+		if c.ttl > 0 {
+			editor.SetTTL(c.ttl)
+		}
+		editor.SetCost(c.cost)
+		if err := writeValues(c, editor, files); err != nil {
+			editor.Abort()
+			return err
+		}
+		return editor.Commit()
+	})
+}
+
+// write each file to a value, stdin is value 0 if no file is given
+func writeValues(c *cli, editor *disklrucache.DiskLRUCacheEditor, files []string) error {
+	if len(files) == 0 {
+		return writeValue(editor, 0, c.stdin)
+	}
+	for i, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = writeValue(editor, i, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeValue(editor *disklrucache.DiskLRUCacheEditor, index int, reader io.Reader) error {
+	writer, err := editor.NewOutputStream(index)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, reader)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func runRm(c *cli, flags *flag.FlagSet, args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	return c.withCache(args, false, func(cache *disklrucache.DiskLRUCache) error {
+		for _, key := range args[1:] {
+			if err := cache.Remove(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func runStats(c *cli, flags *flag.FlagSet, args []string) error {
+	return c.withCache(args, true, func(cache *disklrucache.DiskLRUCache) error {
+		stats := cache.Stats()
+		w := tabwriter.NewWriter(c.stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "entries\t%d\n", stats.Entries)
+		fmt.Fprintf(w, "size\t%d\n", stats.Size)
+		fmt.Fprintf(w, "max size\t%d\n", stats.MaxSize)
+		if stats.MaxEntries > 0 {
+			fmt.Fprintf(w, "max entries\t%d\n", stats.MaxEntries)
+		}
+		fmt.Fprintf(w, "redundant journal lines\t%d\n", stats.RedundantJournalLines)
+		return w.Flush()
+	})
+}
+
+func runCompact(c *cli, flags *flag.FlagSet, args []string) error {
+	return c.withCache(args, false, func(cache *disklrucache.DiskLRUCache) error {
+		return cache.RebuildJournal()
+	})
+}
+
+func verifyFlags(c *cli, flags *flag.FlagSet) {
+	flags.BoolVar(&c.verifyChecksums, "checksums", false, "read the values to compare their checksums")
+	flags.BoolVar(&c.repair, "repair", false, "remove broken entries and orphan files and rewrite the journal")
+}
+
+func runVerify(c *cli, flags *flag.FlagSet, args []string) error {
+	opts := disklrucache.VerifyOptions{Checksums: c.verifyChecksums, Repair: c.repair}
+	return c.withCache(args, !opts.Repair, func(cache *disklrucache.DiskLRUCache) error {
+		report, err := cache.Verify(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "checked %d entries, %d values by checksum\n", report.Entries, report.ChecksummedValues)
+		printList := func(name string, items []string) {
+			for _, item := range items {
+				fmt.Fprintf(c.stdout, "%s: %s\n", name, item)
+			}
+		}
+		printList("missing", report.MissingEntries)
+		printList("size mismatch", report.SizeMismatches)
+		printList("checksum mismatch", report.ChecksumMismatches)
+		printList("orphan file", report.OrphanFiles)
+		printList("unknown file", report.UnknownFiles)
+		if report.CurSize != report.EntriesSize {
+			fmt.Fprintf(c.stdout, "size counted %d, but entries have %d\n", report.CurSize, report.EntriesSize)
+		}
+		if opts.Repair {
+			fmt.Fprintf(c.stdout, "repaired %d problems\n", report.Repaired)
+			return nil
+		}
+		if !report.OK() {
+			return errFailed
+		}
+		fmt.Fprintln(c.stdout, "ok")
+		return nil
+	})
+}
+
+func runDumpJournal(c *cli, flags *flag.FlagSet, args []string) error {
+	scanner, err := disklrucache.OpenJournal(args[0])
+	if err != nil {
+		return err
+	}
+	defer scanner.Close()
+	header := scanner.Header()
+	line := fmt.Sprintf("format=%s app=%d version=%d max-size=%d values=%d keys=%s shards=%d", header.Format,
+		header.AppVersion, header.CacheVersion, header.MaxSize, header.ValueCount, header.KeyMapper, header.ShardLevels)
+	if header.MaxEntries > 0 {
+		line += fmt.Sprintf(" max-entries=%d", header.MaxEntries)
+	}
+	if header.Policy != "" {
+		line += " policy=" + header.Policy
+	}
+	fmt.Fprintln(c.stdout, line)
+	for {
+		record, err := scanner.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line := fmt.Sprintf("%-5s %q", record.Operator, record.Key)
+		if record.Operator == disklrucache.CLEAN {
+			sizes := make([]string, len(record.Sizes))
+			for i, size := range record.Sizes {
+				sizes[i] = strconv.FormatInt(size, 10)
+			}
+			line += fmt.Sprintf(" sizes=%s time=%s", strings.Join(sizes, ","), record.Time.Format(timeLayout))
+			if !record.Expiry.IsZero() {
+				line += " expiry=" + record.Expiry.Format(timeLayout)
+			}
+			if record.Checksum != disklrucache.CHECKSUM_NONE {
+				sums := make([]string, len(record.Sums))
+				for i, sum := range record.Sums {
+					sums[i] = hex.EncodeToString(sum)
+				}
+				line += fmt.Sprintf(" sum=%s:%s", record.Checksum, strings.Join(sums, ","))
+			}
+			if record.Cost > 0 {
+				line += " cost=" + strconv.FormatFloat(record.Cost, 'g', -1, 64)
+			}
+			if record.PolicyState != "" {
+				line += " policy=" + record.PolicyState
+			}
+		}
+		fmt.Fprintln(c.stdout, line)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	disklrucache "github.com/ashesofdream/go-disklrucache"
+)
+
+func runCli(t *testing.T, stdin string, args ...string) (string, int) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	if code == 2 {
+		t.Logf("%s", stderr.String())
+	}
+	return stdout.String(), code
+}
+
+func TestCli(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := disklrucache.Open(dir, disklrucache.Options{AppVersion: 3, CacheVersion: 2, MaxSize: 1000, ShardLevels: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+
+	if _, code := runCli(t, "hello", "-checksum", "crc32c", "put", dir, "a"); code != 0 {
+		t.Fatalf("put from stdin failed, exit %d", code)
+	}
+	file := filepath.Join(t.TempDir(), "value")
+	os.WriteFile(file, []byte("world!"), 0666)
+	if _, code := runCli(t, "", "put", "-ttl", "1h", dir, "b b", file); code != 0 {
+		t.Fatalf("put from file failed, exit %d", code)
+	}
+	if out, code := runCli(t, "", "get", dir, "a"); code != 0 || out != "hello" {
+		t.Errorf("get should print hello, but %q exit %d", out, code)
+	}
+	if _, code := runCli(t, "", "get", dir, "missing"); code != 1 {
+		t.Errorf("get of missing key should exit 1, but %d", code)
+	}
+	// get is read-only, so a stays before b
+	out, _ := runCli(t, "", "ls", dir)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "a ") || !strings.HasPrefix(lines[2], "b b ") {
+		t.Errorf("ls should list a then b\n%s", out)
+	}
+	if out, _ := runCli(t, "", "stats", dir); !strings.Contains(out, "size") || !strings.Contains(out, "11") {
+		t.Errorf("stats should print the size\n%s", out)
+	}
+	if out, code := runCli(t, "", "verify", "-checksums", dir); code != 0 || !strings.Contains(out, "1 values by checksum") {
+		t.Errorf("verify should pass\n%s", out)
+	}
+	out, _ = runCli(t, "", "dump-journal", dir)
+	if !strings.Contains(out, "app=3 version=2 max-size=1000 values=1 keys=escape shards=1") ||
+		!strings.Contains(out, `clean "a" sizes=5`) || !strings.Contains(out, "sum=crc32c:") || !strings.Contains(out, "expiry=") {
+		t.Errorf("dump-journal output error\n%s", out)
+	}
+	if _, code := runCli(t, "", "compact", dir); code != 0 {
+		t.Errorf("compact failed")
+	}
+	if _, code := runCli(t, "", "rm", dir, "a"); code != 0 {
+		t.Errorf("rm failed")
+	}
+	if out, _ := runCli(t, "", "ls", dir); strings.Contains(out, "\na ") {
+		t.Errorf("a should be removed\n%s", out)
+	}
+	// the versions are checked when given
+	if _, code := runCli(t, "", "-app", "4", "ls", dir); code != 1 {
+		t.Errorf("other app version should fail, exit %d", code)
+	}
+	if _, code := runCli(t, "", "-app", "3", "-version", "2", "ls", dir); code != 0 {
+		t.Errorf("same versions should pass, exit %d", code)
+	}
+	// inspecting works while an application has the cache opened
+	cache, err = disklrucache.Open(dir, disklrucache.Options{AppVersion: 3, CacheVersion: 2, MaxSize: 1000, ShardLevels: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, code := runCli(t, "", "get", dir, "b b"); code != 0 || out != "world!" {
+		t.Errorf("get of opened cache should pass, %q exit %d", out, code)
+	}
+	if _, code := runCli(t, "", "rm", dir, "b b"); code != 1 {
+		t.Errorf("rm of opened cache should fail, exit %d", code)
+	}
+	cache.Close()
+	if _, code := runCli(t, "", "unknown", dir); code != 2 {
+		t.Errorf("unknown command should exit 2, but %d", code)
+	}
+}
@@ -0,0 +1,75 @@
+package disklrucache
+
+const (
+	// redundant journal records which start a background compaction, like Android's DiskLruCache
+	DEFAULT_COMPACT_THRESHOLD = 2000
+)
+
+// need lock manually
+func (cache *DiskLRUCache) compactRequired() bool {
+	redundant := cache.redundantJournalLines()
+	return cache.compactThreshold > 0 && redundant >= int64(cache.compactThreshold) &&
+		redundant >= int64(cache.entries.Len())
+}
+
+func (cache *DiskLRUCache) startCompactor(stop chan struct{}) {
+	wake := make(chan struct{}, 1)
+	cache.compactWake = wake
+	cache.background.Add(1)
+	go func() {
+		defer cache.background.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-wake:
+				if err := cache.compact(); err != nil {
+					cache.logger.Printf("warning: compact journal failed,err:%s", err)
+				}
+			}
+		}
+	}()
+}
+
+// like RebuildJournal, but the cache lock is only held to copy the records and to swap the files.
+// records written during the rewrite are collected in compactTail and appended to the new journal
+func (cache *DiskLRUCache) compact() error {
+	if !cache.rebuildLock.TryLock() {
+		// a rebuild is running
+		return nil
+	}
+	defer cache.rebuildLock.Unlock()
+	cache.lock.Lock()
+	if cache.journalFile == nil || !cache.compactRequired() {
+		cache.lock.Unlock()
+		return nil
+	}
+	file, err := cache.newJournal(JOURNAL_TMP_FILENAME)
+	if err != nil {
+		cache.lock.Unlock()
+		return err
+	}
+	lines := cache.journalLines()
+	cache.compactTail = make([]string, 0)
+	cache.lock.Unlock()
+
+	err = writeLines(file, lines)
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	tail := cache.compactTail
+	cache.compactTail = nil
+	if err == nil {
+		err = writeLines(file, tail)
+	}
+	if err != nil {
+		cache.dropTmpJournal(file)
+		return err
+	}
+	if cache.journalFile == nil {
+		// closed while compacting
+		cache.dropTmpJournal(file)
+		return nil
+	}
+	return cache.replaceJournal(file, len(lines)+len(tail))
+}
@@ -2,11 +2,16 @@ package disklrucache
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -278,10 +283,10 @@ func ReadDataRoutine(cache *DiskLRUCache, data []fileData, productSignalchan cha
 		}
 		cur_data := make([]byte, snapshot.Size)
 		n, err := snapshot.Reader.Read(cur_data)
-		f, _ := snapshot.Reader.(*AutoRemoveReader)
-		var name = f.Name()
 		if n == 0 {
-			t.Errorf("Name:%s", name)
+			if f, ok := snapshot.Reader.(interface{ Name() string }); ok {
+				t.Errorf("Name:%s", f.Name())
+			}
 			t.Error("ReadDataRoutine: read data size error")
 		}
 		if snapshot.Size != int64(len(d.data)) {
@@ -648,7 +653,7 @@ func TestRemove(t *testing.T) {
 	if _, err := os.Stat(editor.entry.GetCleanFilename()); os.IsExist(err) {
 		t.Errorf("clean file shoud be deleted")
 	}
-	if _, err := os.Stat(editor.tmpFilename); os.IsExist(err) {
+	if _, err := os.Stat(editor.tmpFilenames[0]); os.IsExist(err) {
 		t.Errorf("dirty file shoud be deleted")
 	}
 
@@ -662,7 +667,7 @@ func TestRemove(t *testing.T) {
 	if cache.curSize != 0 {
 		t.Errorf("curSize should be 0, but %d", cache.curSize)
 	}
-	if _, err := os.Stat(editor.tmpFilename); os.IsExist(err) {
+	if _, err := os.Stat(editor.tmpFilenames[0]); os.IsExist(err) {
 		t.Errorf("dirty file shoud be deleted")
 	}
 	if _, err := os.Stat(editor.entry.GetCleanFilename()); os.IsExist(err) {
@@ -722,3 +727,2231 @@ func TestRacingDel(t *testing.T) {
 	return
 
 }
+
+func TestOpenError(t *testing.T) {
+	fmt.Printf("Testing Open Error...\n")
+	os.RemoveAll(CACHE_DIR)
+	if _, err := Open(CACHE_DIR, Options{AppVersion: 1, CacheVersion: 1}); err == nil {
+		t.Error("open with zero max size should fail")
+	}
+	cache, err := Open(CACHE_DIR, Options{AppVersion: 1, CacheVersion: 1, MaxSize: TEST_DATA_SIZE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+
+	_, err = Open(CACHE_DIR, Options{AppVersion: 2, CacheVersion: 1, MaxSize: TEST_DATA_SIZE})
+	if _, ok := err.(*JournalVersionError); !ok {
+		t.Errorf("open with other app version should return JournalVersionError, but %v", err)
+	}
+
+	journal := filepath.Join(CACHE_DIR, JOURNAL_FILENAME)
+	bad_journals := []string{
+		"not-a-journal\n1 1 1024\n",
+		FILE_HEAD + "\n1 1\n",
+		FILE_HEAD + "\n1 1 1024\nclean key\n",
+		FILE_HEAD + "\n1 1 1024\nclean key size 0\n",
+		FILE_HEAD + "\n1 1 1024\nunknown key\n",
+	}
+	for _, content := range bad_journals {
+		if err := os.WriteFile(journal, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		_, err = Open(CACHE_DIR, Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1024})
+		if _, ok := err.(*JournalFileFormatError); !ok {
+			t.Errorf("journal %q should return JournalFileFormatError, but %v", content, err)
+		}
+	}
+	os.RemoveAll(CACHE_DIR)
+}
+
+func writeEntry(t *testing.T, cache *DiskLRUCache, key string, data []byte) {
+	editor := cache.Edit(key)
+	if editor == nil {
+		t.Fatalf("Edit %s failed", key)
+	}
+	writer, err := editor.CreateOutputStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(data)
+	writer.Close()
+	if err := editor.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	fmt.Printf("Testing Recovery...\n")
+	data := GetAllTestData()[:3]
+	journal := filepath.Join(CACHE_DIR, JOURNAL_FILENAME)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: TEST_DATA_SIZE}
+	prepare := func() {
+		os.RemoveAll(CACHE_DIR)
+		cache, err := Open(CACHE_DIR, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range data {
+			writeEntry(t, cache, d.filename, d.data)
+		}
+		cache.RebuildJournal()
+		cache.Close()
+		f, _ := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0666)
+		f.WriteString("bogus line\n" + READ + " " + data[0].filename + "\n")
+		f.Close()
+	}
+
+	prepare()
+	if _, err := Open(CACHE_DIR, opts); err == nil {
+		t.Error("RECOVERY_FAIL should return the journal error")
+	}
+
+	prepare()
+	truncate_opts := opts
+	truncate_opts.Recovery = RECOVERY_TRUNCATE
+	cache, err := Open(CACHE_DIR, truncate_opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := cache.RecoveryReport()
+	if report == nil || report.Policy != RECOVERY_TRUNCATE || report.DroppedLines != 2 || report.DroppedEntries != 0 {
+		t.Errorf("truncate report error, %+v", report)
+	}
+	if cache.entries.Len() != len(data) {
+		t.Errorf("truncate should keep %d entries, but %d", len(data), cache.entries.Len())
+	}
+	cache.Close()
+	if cache, err = Open(CACHE_DIR, opts); err != nil {
+		t.Fatalf("journal should be rewritten after recovery, %s", err)
+	}
+	cache.Close()
+
+	prepare()
+	backup_opts := opts
+	backup_opts.Recovery = RECOVERY_BACKUP
+	cache, err = Open(CACHE_DIR, backup_opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := cache.RecoveryReport(); report == nil || report.Policy != RECOVERY_BACKUP {
+		t.Errorf("backup report error, %+v", report)
+	}
+	for _, d := range data {
+		snapshot, err := cache.Get(d.filename)
+		if err != nil || snapshot == nil {
+			t.Errorf("entry %s should be loaded from backup, err:%v", d.filename, err)
+			continue
+		}
+		snapshot.Reader.Close()
+	}
+	cache.Close()
+
+	prepare()
+	reset_opts := opts
+	reset_opts.Recovery = RECOVERY_RESET
+	reset_opts.AppVersion = 2
+	cache, err = Open(CACHE_DIR, reset_opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report = cache.RecoveryReport()
+	if report == nil || report.Policy != RECOVERY_RESET || report.DroppedEntries != len(data) {
+		t.Errorf("reset report error, %+v", report)
+	}
+	if _, ok := report.Cause.(*JournalVersionError); !ok {
+		t.Errorf("reset cause should be JournalVersionError, but %v", report.Cause)
+	}
+	if cache.entries.Len() != 0 || cache.curSize != 0 {
+		t.Errorf("cache should be empty after reset")
+	}
+	if _, err := os.Stat(filepath.Join(CACHE_DIR, data[0].filename)); !os.IsNotExist(err) {
+		t.Errorf("entry file should be deleted after reset")
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestAbort(t *testing.T) {
+	fmt.Printf("Testing Abort...\n")
+	data := GetAllTestData()
+	os.RemoveAll(CACHE_DIR)
+	cache := CreateDiskLRUCache(CACHE_DIR, 1, 1, TEST_DATA_SIZE)
+	key := data[0].filename
+
+	// abort a new entry
+	editor := cache.Edit(key)
+	writer, err := editor.CreateOutputStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(data[0].data)
+	writer.Close()
+	if err := editor.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(editor.tmpFilenames[0]); !os.IsNotExist(err) {
+		t.Errorf("dirty file should be deleted")
+	}
+	if snapshot, _ := cache.Get(key); snapshot != nil {
+		t.Errorf("aborted new entry should not be readable")
+	}
+	if err := editor.Commit(); err == nil {
+		t.Errorf("commit after abort should fail")
+	}
+
+	// abort keeps the old value
+	writeEntry(t, cache, key, data[0].data)
+	editor = cache.Edit(key)
+	if editor == nil {
+		t.Fatal("entry should be editable after abort")
+	}
+	writer, _ = editor.CreateOutputStream()
+	writer.Write(data[1].data)
+	writer.Close()
+	// open the stream again should not dead lock
+	writer, _ = editor.CreateAppendStream()
+	writer.Close()
+	editor.Abort()
+	if err := editor.Abort(); err == nil {
+		t.Errorf("abort twice should fail")
+	}
+	check := func(cache *DiskLRUCache) {
+		snapshot, err := cache.Get(key)
+		if err != nil || snapshot == nil {
+			t.Fatalf("old value should be readable after abort, err:%v", err)
+		}
+		defer snapshot.Reader.Close()
+		buf := make([]byte, snapshot.Size)
+		snapshot.Reader.Read(buf)
+		if !bytes.Equal(buf, data[0].data) {
+			t.Errorf("old value changed after abort")
+		}
+	}
+	check(cache)
+
+	// commit without stream should not panic
+	editor = cache.Edit(data[2].filename)
+	if err := editor.Commit(); err == nil {
+		t.Errorf("commit without output stream should fail")
+	}
+	if editor = cache.Edit(data[2].filename); editor == nil {
+		t.Fatal("failed commit should release the entry")
+	}
+	editor.Abort()
+	cache.Close()
+
+	cache = CreateDiskLRUCache(CACHE_DIR, 1, 1, TEST_DATA_SIZE)
+	check(cache)
+	if cache.entries.Len() != 1 {
+		t.Errorf("reopen cache should have 1 entry, but %d", cache.entries.Len())
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestMultiValue(t *testing.T) {
+	fmt.Printf("Testing MultiValue...\n")
+	data := GetAllTestData()
+	os.RemoveAll(CACHE_DIR)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: TEST_DATA_SIZE, ValueCount: 2}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := data[0].filename
+	editor := cache.Edit(key)
+	writer, _ := editor.NewOutputStream(0)
+	writer.Write(data[0].data)
+	writer.Close()
+	if err := editor.Commit(); err == nil {
+		t.Errorf("commit new entry without all values should fail")
+	}
+
+	editor = cache.Edit(key)
+	for i := 0; i < 2; i++ {
+		writer, err := editor.NewOutputStream(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write(data[i].data)
+		writer.Close()
+	}
+	if _, err := editor.NewOutputStream(2); err == nil {
+		t.Errorf("index out of range should fail")
+	}
+	if err := editor.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// only update value 1
+	editor = cache.Edit(key)
+	writer, _ = editor.NewOutputStream(1)
+	writer.Write(data[2].data)
+	writer.Close()
+	if err := editor.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := cache.Get(key)
+	if err != nil || snapshot == nil {
+		t.Fatalf("get multi value entry failed, err:%v", err)
+	}
+	expect := [][]byte{data[0].data, data[2].data}
+	for i, value := range expect {
+		if snapshot.GetSize(i) != int64(len(value)) {
+			t.Errorf("value %d size error, %d %d", i, snapshot.GetSize(i), len(value))
+		}
+		buf := make([]byte, snapshot.GetSize(i))
+		snapshot.GetReader(i).Read(buf)
+		if !bytes.Equal(buf, value) {
+			t.Errorf("value %d not equal", i)
+		}
+	}
+	if snapshot.Size != int64(len(expect[0])+len(expect[1])) || cache.curSize != snapshot.Size {
+		t.Errorf("total size error, %d %d", snapshot.Size, cache.curSize)
+	}
+	snapshot.Close()
+	cache.Remove(key)
+	for i := 0; i < 2; i++ {
+		if _, err := os.Stat(filepath.Join(CACHE_DIR, fmt.Sprintf("%s.%d", key, i))); !os.IsNotExist(err) {
+			t.Errorf("value file %d should be removed", i)
+		}
+	}
+	cache.Close()
+
+	opts.ValueCount = 3
+	if _, err := Open(CACHE_DIR, opts); err == nil {
+		t.Errorf("open with other value count should fail")
+	}
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestKeyEncoding(t *testing.T) {
+	fmt.Printf("Testing KeyEncoding...\n")
+	data := GetAllTestData()
+	keys := []string{"../../escape", "a/b", "with space", "new\nline", "100%", "中文 key", ".", JOURNAL_FILENAME}
+	for _, mapper := range []KeyMapper{EscapeKeyMapper{}, HashKeyMapper{}} {
+		os.RemoveAll(CACHE_DIR)
+		opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: TEST_DATA_SIZE, KeyMapper: mapper}
+		cache, err := Open(CACHE_DIR, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, key := range keys {
+			writeEntry(t, cache, key, data[i].data)
+		}
+		if _, err := cache.TryEdit(""); err == nil {
+			t.Errorf("empty key should be rejected")
+		}
+		if name, _ := mapper.Filename(JOURNAL_FILENAME); name == JOURNAL_FILENAME {
+			t.Errorf("%s: key of journal filename should be escaped", mapper.Name())
+		}
+		if key, err := (EscapeKeyMapper{}).Key("%6Aournal"); err != nil || key != JOURNAL_FILENAME {
+			t.Errorf("escaped journal filename should be read back, %q %v", key, err)
+		}
+		cache.Close()
+
+		// all files should be in cache dir, with the journal and its lock
+		items, _ := os.ReadDir(CACHE_DIR)
+		if len(items) != len(keys)+2 {
+			t.Errorf("%s: cache dir should have %d files, but %d", mapper.Name(), len(keys)+2, len(items))
+		}
+		if _, err := os.Stat(filepath.Join(CACHE_DIR, "..", "..", "escape")); !os.IsNotExist(err) {
+			t.Errorf("%s: key escaped the cache dir", mapper.Name())
+		}
+
+		cache, err = Open(CACHE_DIR, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, key := range keys {
+			snapshot, err := cache.Get(key)
+			if err != nil || snapshot == nil {
+				t.Errorf("%s: get %q failed, err:%v", mapper.Name(), key, err)
+				continue
+			}
+			buf := make([]byte, snapshot.Size)
+			snapshot.Reader.Read(buf)
+			snapshot.Close()
+			if !bytes.Equal(buf, data[i].data) {
+				t.Errorf("%s: value of %q not equal", mapper.Name(), key)
+			}
+		}
+		cache.Close()
+	}
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: TEST_DATA_SIZE}
+	if _, err := Open(CACHE_DIR, opts); err == nil {
+		t.Errorf("open with other key mapper should fail")
+	}
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestLegacyKeyJournal(t *testing.T) {
+	fmt.Printf("Testing LegacyKeyJournal...\n")
+	os.RemoveAll(CACHE_DIR)
+	os.MkdirAll(CACHE_DIR, 0777)
+	// journal of the first version, files are named by the keys and "a." is escaped to "a%2E"
+	keys := []string{"img.png", "a.", "a%2E", "plain"}
+	journal := FILE_HEAD + "\n1 1 1000\n"
+	for _, key := range keys {
+		os.WriteFile(filepath.Join(CACHE_DIR, key), []byte(key), 0666)
+		journal += fmt.Sprintf("dirty %s\nclean %s %d 1700000000000\n", key, key, len(key))
+	}
+	journal += "read img.png\n"
+	journalName := filepath.Join(CACHE_DIR, JOURNAL_FILENAME)
+	os.WriteFile(journalName, []byte(journal), 0666)
+	checkValues := func(cache *DiskLRUCache) {
+		for _, key := range keys {
+			snapshot, err := cache.Get(key)
+			if err != nil || snapshot == nil {
+				t.Errorf("get %q failed, err:%v", key, err)
+				continue
+			}
+			if data, _ := io.ReadAll(snapshot.Reader); string(data) != key {
+				t.Errorf("value of %q error, %q", key, data)
+			}
+			snapshot.Close()
+		}
+	}
+
+	// read-only reads the files where they are
+	reader, err := Open(CACHE_DIR, Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValues(reader)
+	reader.Close()
+	if _, err := os.Stat(filepath.Join(CACHE_DIR, "img.png")); err != nil {
+		t.Errorf("read-only cache should not migrate files")
+	}
+	// converted keys stay raw
+	if err := ConvertJournal(CACHE_DIR, JOURNAL_BINARY); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConvertJournal(CACHE_DIR, JOURNAL_TEXT); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(journalName); string(data) != journal {
+		t.Errorf("legacy journal should be converted back as it is, %q", data)
+	}
+
+	// a writer renames the files to its mapper
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := cache.ReconcileReport(); report != nil && (report.MissingEntries != 0 || report.UnknownFiles != 0) {
+		t.Errorf("legacy files should be migrated, %+v", report)
+	}
+	if stats := cache.Stats(); stats.Entries != int64(len(keys)) || stats.Size != int64(len(strings.Join(keys, ""))) {
+		t.Errorf("legacy entries should be kept, %+v", stats)
+	}
+	checkValues(cache)
+	cache.Close()
+	if _, err := os.Stat(filepath.Join(CACHE_DIR, "img.png")); !os.IsNotExist(err) {
+		t.Errorf("legacy file should be renamed")
+	}
+	if data, _ := os.ReadFile(journalName); !strings.Contains(string(data), " keys=escape") {
+		t.Errorf("journal should be rewritten with the key mapper, %q", data)
+	}
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkValues(cache)
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestShardLayout(t *testing.T) {
+	fmt.Printf("Testing ShardLayout...\n")
+	data := GetAllTestData()[:10]
+	os.RemoveAll(CACHE_DIR)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: TEST_DATA_SIZE, ShardLevels: 2}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range data {
+		writeEntry(t, cache, d.filename, d.data)
+	}
+	name := filepath.Join(CACHE_DIR, shardDir(data[0].filename, 2), data[0].filename)
+	if _, err := os.Stat(name); err != nil {
+		t.Errorf("entry file should be in shard dir, %s", err)
+	}
+	cache.Remove(data[0].filename)
+	if _, err := os.Stat(filepath.Dir(name)); !os.IsNotExist(err) {
+		t.Errorf("empty shard dir should be removed")
+	}
+	cache.Close()
+
+	check := func(levels int) {
+		opts.ShardLevels = levels
+		cache, err := Open(CACHE_DIR, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cache.Close()
+		for _, d := range data[1:] {
+			if _, err := os.Stat(filepath.Join(CACHE_DIR, shardDir(d.filename, levels), d.filename)); err != nil {
+				t.Errorf("levels %d: entry file not migrated, %s", levels, err)
+			}
+			snapshot, err := cache.Get(d.filename)
+			if err != nil || snapshot == nil {
+				t.Errorf("levels %d: get %s failed, err:%v", levels, d.filename, err)
+				continue
+			}
+			buf := make([]byte, snapshot.Size)
+			snapshot.Reader.Read(buf)
+			snapshot.Close()
+			if !bytes.Equal(buf, d.data) {
+				t.Errorf("levels %d: value of %s not equal", levels, d.filename)
+			}
+		}
+		items, _ := os.ReadDir(CACHE_DIR)
+		for _, item := range items {
+			if item.IsDir() && levels == 0 {
+				t.Errorf("shard dir %s should be removed after migrate to flat", item.Name())
+			}
+		}
+	}
+	check(0)
+	check(1)
+	check(2)
+	os.RemoveAll(CACHE_DIR)
+}
+
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestExpire(t *testing.T) {
+	fmt.Printf("Testing Expire...\n")
+	data := GetAllTestData()
+	os.RemoveAll(CACHE_DIR)
+	clock := &fakeClock{now: time.UnixMilli(1700000000000)}
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: TEST_DATA_SIZE, Clock: clock}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, d := range data[:3] {
+		editor := cache.Edit(d.filename)
+		writer, _ := editor.CreateOutputStream()
+		writer.Write(d.data)
+		writer.Close()
+		if i < 2 {
+			editor.SetTTL(time.Duration(i+1) * time.Hour)
+		}
+		editor.Commit()
+	}
+	cache.Close()
+
+	// expiry is kept in journal
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, _ := cache.Get(data[0].filename)
+	if snapshot == nil || !snapshot.Expiry.Equal(clock.Now().Add(time.Hour)) {
+		t.Fatalf("expiry should be loaded from journal, %v", snapshot)
+	}
+	snapshot.Close()
+	clock.Add(90 * time.Minute)
+	if snapshot, _ := cache.Get(data[0].filename); snapshot != nil {
+		t.Errorf("expired entry should be a miss")
+	}
+	if _, err := os.Stat(filepath.Join(CACHE_DIR, data[0].filename)); !os.IsNotExist(err) {
+		t.Errorf("expired entry file should be deleted")
+	}
+	if cache.curSize != data[1].size+data[2].size {
+		t.Errorf("curSize error, %d", cache.curSize)
+	}
+	cache.Close()
+
+	// sweeper removes entries without read
+	opts.SweepInterval = 10 * time.Millisecond
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Add(time.Hour)
+	for i := 0; i < 100; i++ {
+		cache.lock.RLock()
+		n := cache.entries.Len()
+		cache.lock.RUnlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cache.Close()
+	cache, err = Open(CACHE_DIR, Options{AppVersion: 1, CacheVersion: 1, MaxSize: TEST_DATA_SIZE, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.entries.Len() != 1 || cache.entries.Peek(data[2].filename) == nil {
+		t.Errorf("only the entry without ttl should be kept, but %d entries", cache.entries.Len())
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestStats(t *testing.T) {
+	fmt.Printf("Testing Stats...\n")
+	os.RemoveAll(CACHE_DIR)
+	cache, err := Open(CACHE_DIR, Options{AppVersion: 1, CacheVersion: 1, MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEntry(t, cache, "a", []byte("aaaa"))
+	writeEntry(t, cache, "b", []byte("bbbb"))
+	snapshot, _ := cache.Get("a")
+	if snapshot == nil {
+		t.Fatal("get a failed")
+	}
+	cache.Get("c")
+	editor := cache.Edit("c")
+	editor.Abort()
+	// b is evicted
+	writeEntry(t, cache, "d", []byte("dddd"))
+	cache.Remove("d")
+	cache.Remove("d")
+
+	stats := cache.Stats()
+	expect := Stats{Hits: 1, Misses: 1, Puts: 4, Commits: 3, Aborts: 1, Evictions: 1, EvictionBytes: 4, Removals: 1,
+		Size: 4, Entries: 1, MaxSize: 10, OpenReaders: 1}
+	// dirty a, clean a, dirty b, clean b, read a, dirty c, del c, dirty d, clean d, del b, del d
+	expect.RedundantJournalLines = 11 - 1
+	if stats != expect {
+		t.Errorf("stats error\n%+v\nexpect\n%+v", stats, expect)
+	}
+	snapshot.Close()
+	snapshot.Close()
+	if n := cache.Stats().OpenReaders; n != 0 {
+		t.Errorf("open readers should be 0 after close, but %d", n)
+	}
+	if err := cache.RebuildJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if n := cache.Stats().RedundantJournalLines; n != 0 {
+		t.Errorf("redundant lines should be 0 after rebuild, but %d", n)
+	}
+	cache.Close()
+
+	cache, err = Open(CACHE_DIR, Options{AppVersion: 1, CacheVersion: 1, MaxSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Get("a")
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Puts != 0 || stats.RedundantJournalLines != 1 {
+		t.Errorf("stats of reopened cache error, %+v", stats)
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestOnEvict(t *testing.T) {
+	fmt.Printf("Testing OnEvict...\n")
+	os.RemoveAll(CACHE_DIR)
+	clock := &fakeClock{now: time.UnixMilli(1700000000000)}
+	cache, err := Open(CACHE_DIR, Options{AppVersion: 1, CacheVersion: 1, MaxSize: 10, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []EvictionEvent
+	var values []string
+	cache.OnEvict(func(event EvictionEvent) {
+		// the lock is released, so the cache can be used in listener
+		cache.Stats()
+		var data []byte
+		if reader := event.GetReader(0); reader != nil {
+			data, err = io.ReadAll(reader)
+			if err != nil {
+				t.Errorf("read evicted value failed, err:%s", err)
+			}
+		}
+		events = append(events, event)
+		values = append(values, string(data))
+	})
+	writeEntry(t, cache, "a", []byte("aaaa"))
+	clock.Add(time.Minute)
+	writeEntry(t, cache, "b", []byte("bbbb"))
+	clock.Add(time.Minute)
+	cache.Get("b")
+	// replace b and evict a
+	writeEntry(t, cache, "b", []byte("bbbbb"))
+	writeEntry(t, cache, "c", []byte("cc"))
+	cache.Remove("c")
+	editor := cache.Edit("d")
+	editor.SetTTL(time.Second)
+	writer, _ := editor.CreateOutputStream()
+	writer.Write([]byte("d"))
+	writer.Close()
+	editor.Commit()
+	clock.Add(time.Second)
+	cache.Get("d")
+	os.Remove(filepath.Join(CACHE_DIR, "b"))
+	cache.Get("b")
+
+	expect := []struct {
+		key    string
+		value  string
+		reason EvictReason
+	}{
+		{"b", "bbbb", EVICT_REPLACED},
+		{"a", "aaaa", EVICT_CAPACITY},
+		{"c", "cc", EVICT_REMOVED},
+		{"d", "d", EVICT_EXPIRED},
+		{"b", "", EVICT_CORRUPT},
+	}
+	if len(events) != len(expect) {
+		t.Fatalf("expect %d events, but %d", len(expect), len(events))
+	}
+	for i, e := range expect {
+		event := events[i]
+		if event.Key != e.key || event.Reason != e.reason || e.reason != EVICT_CORRUPT && values[i] != e.value {
+			t.Errorf("event %d error, %s %s %q", i, event.Key, event.Reason, values[i])
+		}
+	}
+	if events[0].Age != 2*time.Minute-time.Minute || !events[0].LastAccess.Equal(clock.now.Add(-time.Second)) {
+		t.Errorf("age or last access of replaced event error, %s %s", events[0].Age, events[0].LastAccess)
+	}
+	if events[1].Age != 2*time.Minute || events[1].Size != 4 {
+		t.Errorf("age or size of capacity event error, %s %d", events[1].Age, events[1].Size)
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestCompactJournal(t *testing.T) {
+	fmt.Printf("Testing Compact Journal...\n")
+	os.RemoveAll(CACHE_DIR)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000, CompactThreshold: 50}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"a", "b", "c", "d"}
+	for _, key := range keys {
+		writeEntry(t, cache, key, []byte(key))
+	}
+	// read while compacting in background
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if snapshot, _ := cache.Get(keys[(i+j)%len(keys)]); snapshot != nil {
+					snapshot.Close()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 100; i++ {
+		if cache.Stats().RedundantJournalLines < 50 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := cache.Stats().RedundantJournalLines; n >= 50 {
+		t.Errorf("journal should be compacted, but %d redundant lines", n)
+	}
+	if _, err := os.Stat(filepath.Join(CACHE_DIR, JOURNAL_BACKUP_FILE)); err != nil {
+		t.Errorf("compact should backup the journal, err:%s", err)
+	}
+	cache.Close()
+	if lines := countJournalLines(filepath.Join(CACHE_DIR, JOURNAL_FILENAME)); lines >= 4+50 {
+		t.Errorf("journal has %d lines after compact", lines)
+	}
+
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		snapshot, err := cache.Get(key)
+		if snapshot == nil {
+			t.Fatalf("get %s after compact failed, err:%v", key, err)
+		}
+		snapshot.Close()
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+const CRASH_DIR = "./test/crash"
+
+// crashDisk replaces syncFile and syncDir to remember what is synced,
+// crash builds the worst case of a power loss: files and directory entries never synced are lost
+type crashDisk struct {
+	lock  sync.Mutex
+	root  string
+	files []crashFile
+	dirs  map[string][]crashDirItem
+}
+
+type crashFile struct {
+	info os.FileInfo
+	data []byte
+}
+
+type crashDirItem struct {
+	name string
+	info os.FileInfo
+}
+
+func newCrashDisk(t *testing.T, root string) *crashDisk {
+	disk := &crashDisk{root: root, dirs: make(map[string][]crashDirItem)}
+	oldSyncFile, oldSyncDir := syncFile, syncDir
+	t.Cleanup(func() {
+		syncFile, syncDir = oldSyncFile, oldSyncDir
+	})
+	syncFile = func(file *os.File) error {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(file.Name())
+		if err != nil {
+			return err
+		}
+		disk.lock.Lock()
+		defer disk.lock.Unlock()
+		for i := range disk.files {
+			if os.SameFile(disk.files[i].info, info) {
+				disk.files[i].data = data
+				return nil
+			}
+		}
+		disk.files = append(disk.files, crashFile{info: info, data: data})
+		return nil
+	}
+	syncDir = func(dir string) error {
+		rel, err := filepath.Rel(disk.root, dir)
+		if err != nil {
+			return err
+		}
+		items, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		synced := make([]crashDirItem, 0, len(items))
+		for _, item := range items {
+			info, err := os.Lstat(filepath.Join(dir, item.Name()))
+			if err != nil {
+				continue
+			}
+			synced = append(synced, crashDirItem{name: item.Name(), info: info})
+		}
+		disk.lock.Lock()
+		defer disk.lock.Unlock()
+		disk.dirs[rel] = synced
+		return nil
+	}
+	return disk
+}
+
+// write the durable state to dst
+func (disk *crashDisk) crash(t *testing.T, dst string) {
+	disk.lock.Lock()
+	defer disk.lock.Unlock()
+	os.RemoveAll(dst)
+	var build func(rel string)
+	build = func(rel string) {
+		if err := os.MkdirAll(filepath.Join(dst, rel), 0777); err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range disk.dirs[rel] {
+			if item.info.IsDir() {
+				build(filepath.Join(rel, item.name))
+				continue
+			}
+			// a file never synced is empty
+			var data []byte
+			for _, file := range disk.files {
+				if os.SameFile(file.info, item.info) {
+					data = file.data
+				}
+			}
+			if err := os.WriteFile(filepath.Join(dst, rel, item.name), data, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	build(".")
+}
+
+// open the crashed copy and check the values of keys
+func checkCrashed(t *testing.T, opts Options, keys []string) {
+	opts.Durability = DURABILITY_NONE
+	cache, err := Open(CRASH_DIR, opts)
+	if err != nil {
+		t.Fatalf("open crashed cache failed, err:%s", err)
+	}
+	defer cache.Close()
+	for _, key := range keys {
+		snapshot, err := cache.Get(key)
+		if snapshot == nil {
+			t.Fatalf("%s is lost after crash, err:%v", key, err)
+		}
+		data, _ := io.ReadAll(snapshot.Reader)
+		snapshot.Close()
+		if string(data) != key {
+			t.Fatalf("value of %s is %q after crash", key, data)
+		}
+	}
+}
+
+func TestDurability(t *testing.T) {
+	fmt.Printf("Testing Durability...\n")
+	if runtime.GOOS == "windows" {
+		t.Skip("directories are not synced on windows")
+	}
+	for _, durability := range []Durability{DURABILITY_COMMIT, DURABILITY_GROUP} {
+		os.RemoveAll(CACHE_DIR)
+		disk := newCrashDisk(t, CACHE_DIR)
+		opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1 << 20, ShardLevels: 1, Durability: durability}
+		cache, err := Open(CACHE_DIR, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		var keysLock sync.Mutex
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					key := fmt.Sprintf("key_%d_%d", i, j)
+					writeEntry(t, cache, key, []byte(key))
+					keysLock.Lock()
+					keys = append(keys, key)
+					keysLock.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+		// every commit returned is durable without Close
+		disk.crash(t, CRASH_DIR)
+		checkCrashed(t, opts, keys)
+		cache.Close()
+	}
+
+	// nothing is synced
+	os.RemoveAll(CACHE_DIR)
+	disk := newCrashDisk(t, CACHE_DIR)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1 << 20}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEntry(t, cache, "a", []byte("a"))
+	disk.crash(t, CRASH_DIR)
+	if snapshot, _ := cache.Get("a"); snapshot != nil {
+		snapshot.Close()
+	}
+	cache.Close()
+	if items, _ := os.ReadDir(CRASH_DIR); len(items) != 0 {
+		t.Errorf("nothing should be durable without sync, but %d files", len(items))
+	}
+
+	// synced in background
+	os.RemoveAll(CACHE_DIR)
+	disk = newCrashDisk(t, CACHE_DIR)
+	opts = Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1 << 20, Durability: DURABILITY_PERIODIC, SyncInterval: 10 * time.Millisecond}
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEntry(t, cache, "a", []byte("a"))
+	for i := 0; i < 100; i++ {
+		disk.crash(t, CRASH_DIR)
+		if journal, _ := os.ReadFile(filepath.Join(CRASH_DIR, JOURNAL_FILENAME)); bytes.Contains(journal, []byte("clean a ")) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkCrashed(t, opts, []string{"a"})
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+	os.RemoveAll(CRASH_DIR)
+}
+
+func TestBufferedJournal(t *testing.T) {
+	fmt.Printf("Testing Buffered Journal...\n")
+	os.RemoveAll(CACHE_DIR)
+	journal := func(name string) string {
+		data, _ := os.ReadFile(filepath.Join(CACHE_DIR, name))
+		return string(data)
+	}
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000, FlushInterval: time.Hour}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEntry(t, cache, "a", []byte("a"))
+	if !strings.Contains(journal(JOURNAL_FILENAME), "clean a ") {
+		t.Errorf("clean record should be flushed by commit")
+	}
+	snapshot, _ := cache.Get("a")
+	snapshot.Close()
+	if strings.Contains(journal(JOURNAL_FILENAME), "read a") {
+		t.Errorf("read record should be buffered")
+	}
+	if err := cache.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(journal(JOURNAL_FILENAME), "read a") {
+		t.Errorf("read record should be written by Flush")
+	}
+	cache.Remove("a")
+	if err := cache.RebuildJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(journal(JOURNAL_BACKUP_FILE), "del a") {
+		t.Errorf("buffered records should be flushed to the backup journal by RebuildJournal")
+	}
+	writeEntry(t, cache, "b", []byte("b"))
+	cache.Get("b")
+	cache.Close()
+	if !strings.Contains(journal(JOURNAL_FILENAME), "read b") {
+		t.Errorf("buffered records should be flushed by Close")
+	}
+
+	// flushed in background
+	opts.FlushInterval = 10 * time.Millisecond
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Remove("b")
+	for i := 0; i < 100 && !strings.Contains(journal(JOURNAL_FILENAME), "del b"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(journal(JOURNAL_FILENAME), "del b") {
+		t.Errorf("buffered records should be flushed by interval")
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestTornTextJournal(t *testing.T) {
+	fmt.Printf("Testing Torn Text Journal...\n")
+	os.RemoveAll(CACHE_DIR)
+	journalName := filepath.Join(CACHE_DIR, JOURNAL_FILENAME)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000, JournalBufferSize: 64, FlushInterval: time.Hour}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"a", "bbbbbbbb", "ccccccccc", "ddddddddddd", "eeeeeeeeeeeee", "ffffffffffffff", "ggggggggggggggg"}
+	for _, key := range keys {
+		writeEntry(t, cache, key, []byte(key))
+	}
+	// the buffer is only flushed at record boundaries, so the live journal can be opened read-only
+	readOpts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000, ReadOnly: true}
+	for i := 0; i < 50; i++ {
+		for _, key := range keys {
+			snapshot, _ := cache.Get(key)
+			snapshot.Close()
+		}
+		if data, _ := os.ReadFile(journalName); data[len(data)-1] != '\n' {
+			t.Fatalf("journal should end with a whole record, %q", data[len(data)-20:])
+		}
+		reader, err := Open(CACHE_DIR, readOpts)
+		if err != nil {
+			t.Fatalf("open live journal read-only failed, %v", err)
+		}
+		if reader.Stats().Entries != int64(len(keys)) {
+			t.Errorf("read-only cache should have all entries, %+v", reader.Stats())
+		}
+		reader.Close()
+	}
+	cache.Close()
+
+	// a line torn by a crash is ignored read-only and truncated by the writer
+	journal, _ := os.ReadFile(journalName)
+	os.WriteFile(journalName, append(append([]byte{}, journal...), "read bbb"...), 0666)
+	reader, err := Open(CACHE_DIR, readOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := cache.RecoveryReport(); report == nil || report.DroppedLines != 1 {
+		t.Errorf("torn line should be reported, %+v", report)
+	}
+	if cache.Stats().Entries != int64(len(keys)) {
+		t.Errorf("entries before the torn line should be kept, %+v", cache.Stats())
+	}
+	cache.Close()
+	if data, _ := os.ReadFile(journalName); !bytes.Equal(data, journal) {
+		t.Errorf("torn line should be truncated")
+	}
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestBinaryJournal(t *testing.T) {
+	fmt.Printf("Testing Binary Journal...\n")
+	os.RemoveAll(CACHE_DIR)
+	journalName := filepath.Join(CACHE_DIR, JOURNAL_FILENAME)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000, JournalFormat: JOURNAL_BINARY}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEntry(t, cache, "a", []byte("aa"))
+	editor := cache.Edit("b b")
+	editor.SetExpiry(time.UnixMilli(4102444800000))
+	writer, _ := editor.CreateOutputStream()
+	writer.Write([]byte("bbb"))
+	writer.Close()
+	editor.Commit()
+	writeEntry(t, cache, "c", []byte("c"))
+	cache.Get("a")
+	cache.Remove("c")
+	cache.Close()
+	data, _ := os.ReadFile(journalName)
+	if !bytes.HasPrefix(data, []byte(FILE_HEAD_BINARY+"\n")) {
+		t.Fatalf("binary journal head error, %q", data[:min(len(data), 30)])
+	}
+
+	check := func(cache *DiskLRUCache) {
+		t.Helper()
+		if cache.entries.Len() != 2 || cache.curSize != 5 {
+			t.Fatalf("entries error, %d entries of %d bytes", cache.entries.Len(), cache.curSize)
+		}
+		if b := cache.entries.Peek("b b"); b == nil || b.meta.expiry.UnixMilli() != 4102444800000 {
+			t.Fatalf("entry b error, %+v", b)
+		}
+		// a is read after b
+		if cache.entries.data_list.head.val.key != "b b" {
+			t.Errorf("LRU order error, head is %s", cache.entries.data_list.head.val.key)
+		}
+	}
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(cache)
+	cache.Close()
+
+	// a torn record at the end is truncated
+	good, _ := os.ReadFile(journalName)
+	torn := encodeRecord(JOURNAL_BINARY, journalRecord{operator: DEL, key: "a"})
+	os.WriteFile(journalName, append(append([]byte{}, good...), torn[:len(torn)-2]...), 0666)
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(cache)
+	if report := cache.RecoveryReport(); report == nil || report.Policy != RECOVERY_TRUNCATE {
+		t.Errorf("torn record should be reported, %+v", report)
+	}
+	cache.Close()
+	if data, _ := os.ReadFile(journalName); !bytes.Equal(data, good) {
+		t.Errorf("journal should be truncated to %d bytes, but %d", len(good), len(data))
+	}
+	// so is a record with bad checksum
+	bad := []byte(torn)
+	bad[2] ^= 0xff
+	os.WriteFile(journalName, append(append([]byte{}, good...), bad...), 0666)
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(cache)
+	cache.Close()
+
+	// opened as text, the journal is converted
+	opts.JournalFormat = JOURNAL_TEXT
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(cache)
+	cache.Close()
+	data, _ = os.ReadFile(journalName)
+	if !bytes.HasPrefix(data, []byte(FILE_HEAD+"\n")) {
+		t.Fatalf("journal should be converted to text, %q", data[:min(len(data), 30)])
+	}
+
+	// convert keeps every record
+	lines := countJournalLines(journalName)
+	if err := ConvertJournal(CACHE_DIR, JOURNAL_BINARY); err != nil {
+		t.Fatal(err)
+	}
+	if n := countJournalLines(journalName); n != lines {
+		t.Errorf("convert should keep %d records, but %d", lines, n)
+	}
+	if err := ConvertJournal(CACHE_DIR, JOURNAL_TEXT); err != nil {
+		t.Fatal(err)
+	}
+	if converted, _ := os.ReadFile(journalName); !bytes.Equal(converted, data) {
+		t.Errorf("journal converted back is different\n%s\n%s", converted, data)
+	}
+	opts.JournalFormat = JOURNAL_BINARY
+	ConvertJournal(CACHE_DIR, JOURNAL_BINARY)
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(cache)
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestChecksum(t *testing.T) {
+	fmt.Printf("Testing Checksum...\n")
+	for input, want := range map[string]uint64{"": 0xef46db3751d8e999, "a": 0xd24ec4f1a98c6e5b, "abc": 0x44bc2cf5ad770999} {
+		h := newXXHash64()
+		h.Write([]byte(input))
+		if h.Sum64() != want {
+			t.Errorf("xxhash of %q should be %x, but %x", input, want, h.Sum64())
+		}
+	}
+	long := bytes.Repeat([]byte("0123456789"), 10)
+	whole := newXXHash64()
+	whole.Write(long)
+	pieces := newXXHash64()
+	for i := 0; i < len(long); i += 7 {
+		pieces.Write(long[i:min(i+7, len(long))])
+	}
+	if whole.Sum64() != pieces.Sum64() {
+		t.Errorf("xxhash of pieces should equal to the whole")
+	}
+
+	for _, checksum := range []ChecksumType{CHECKSUM_CRC32C, CHECKSUM_XXHASH, CHECKSUM_SHA256} {
+		for _, format := range []JournalFormat{JOURNAL_TEXT, JOURNAL_BINARY} {
+			os.RemoveAll(CACHE_DIR)
+			opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000, Checksum: checksum, JournalFormat: format}
+			cache, err := Open(CACHE_DIR, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeEntry(t, cache, "a", []byte("aaaa"))
+			// random writes are hashed again by Commit
+			editor := cache.Edit("b")
+			writer, _ := editor.CreateRandomWriter()
+			writer.WriteAt([]byte("bb"), 2)
+			writer.WriteAt([]byte("bb"), 0)
+			writer.Close()
+			if err := editor.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			cache.Close()
+
+			cache, err = Open(CACHE_DIR, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events := 0
+			cache.OnEvict(func(e EvictionEvent) {
+				if e.Key == "a" && e.Reason == EVICT_CORRUPT {
+					events++
+				}
+			})
+			for _, key := range []string{"a", "b"} {
+				entry := cache.entries.Peek(key)
+				sum, _ := fileChecksum(checksum, entry.GetCleanFilename())
+				if entry.meta.checksum != checksum || len(entry.meta.sums) != 1 || !bytes.Equal(entry.meta.sums[0], sum) {
+					t.Fatalf("%s %s checksum of %s error, %+v", checksum, format, key, entry.meta)
+				}
+			}
+			snapshot, _ := cache.Get("b")
+			if data, err := io.ReadAll(snapshot.Reader); err != nil || string(data) != "bbbb" {
+				t.Errorf("read b error, %q %v", data, err)
+			}
+			snapshot.Close()
+
+			os.WriteFile(cache.entries.Peek("a").GetCleanFilename(), []byte("aaab"), 0666)
+			snapshot, _ = cache.Get("a")
+			_, err = io.ReadAll(snapshot.Reader)
+			snapshot.Close()
+			var corrupt *CorruptEntryError
+			if !errors.As(err, &corrupt) || corrupt.Key != "a" {
+				t.Errorf("%s corrupt value should return CorruptEntryError, but %v", checksum, err)
+			}
+			if cache.entries.Peek("a") != nil || events != 1 || cache.Stats().Corruptions != 1 {
+				t.Errorf("corrupt entry should be evicted, %d events", events)
+			}
+			cache.Close()
+		}
+	}
+
+	// entries written without checksum are not verified
+	os.RemoveAll(CACHE_DIR)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEntry(t, cache, "a", []byte("aaaa"))
+	cache.Close()
+	opts.Checksum = CHECKSUM_CRC32C
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(cache.entries.Peek("a").GetCleanFilename(), []byte("aaab"), 0666)
+	snapshot, _ := cache.Get("a")
+	if data, err := io.ReadAll(snapshot.Reader); err != nil || string(data) != "aaab" {
+		t.Errorf("unverified entry should be read, %q %v", data, err)
+	}
+	snapshot.Close()
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestReconcile(t *testing.T) {
+	fmt.Printf("Testing Reconcile...\n")
+	os.RemoveAll(CACHE_DIR)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000, ShardLevels: 1}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		writeEntry(t, cache, key, []byte(key+key))
+	}
+	// editors left by a crash
+	var tmpFiles []string
+	for _, key := range []string{"a", "d"} {
+		editor := cache.Edit(key)
+		writer, _ := editor.CreateOutputStream()
+		writer.Write([]byte("tmp"))
+		writer.Close()
+		tmpFiles = append(tmpFiles, editor.tmpFilenames[0])
+	}
+	a, b, c := cache.entries.Peek("a"), cache.entries.Peek("b"), cache.entries.Peek("c")
+	cache.Close()
+	os.Remove(b.GetCleanFilename())
+	os.WriteFile(c.GetCleanFilename(), []byte("c"), 0666)
+	os.WriteFile(a.GetCleanFilename()+".link0", []byte("aa"), 0666)
+	adoptName := filepath.Join(CACHE_DIR, shardDir("x", 1), "x")
+	os.MkdirAll(filepath.Dir(adoptName), 0777)
+	os.WriteFile(adoptName, []byte("xxx"), 0666)
+	junkName := filepath.Join(CACHE_DIR, "junk.txt")
+	os.WriteFile(junkName, []byte("junk"), 0666)
+
+	opts.UnknownFiles = UNKNOWN_FILES_ADOPT
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ReconcileReport{DirtyEntries: 1, MissingEntries: 1, SizeMismatches: 1, OrphanFiles: 3, UnknownFiles: 1, AdoptedEntries: 1}
+	if report := cache.ReconcileReport(); report == nil || *report != want {
+		t.Errorf("reconcile report should be %+v, but %+v", want, report)
+	}
+	if cache.entries.Len() != 2 || cache.curSize != 5 || cache.entries.data_list.head.val.key != "x" {
+		t.Errorf("entries error, %s of %d bytes", cache.entries.ToString(), cache.curSize)
+	}
+	for _, name := range append(tmpFiles, b.GetCleanFilename(), c.GetCleanFilename()) {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed", name)
+		}
+	}
+	if snapshot, _ := cache.Get("x"); snapshot == nil || snapshot.Size != 3 {
+		t.Errorf("adopted entry should be read")
+	} else {
+		snapshot.Close()
+	}
+	cache.Close()
+
+	// the journal is rewritten, only the unknown file is found again
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := cache.ReconcileReport(); report == nil || *report != (ReconcileReport{UnknownFiles: 1}) {
+		t.Errorf("only junk should be reported, %+v", report)
+	}
+	cache.Close()
+	opts.UnknownFiles = UNKNOWN_FILES_DELETE
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+	if _, err := os.Stat(junkName); !os.IsNotExist(err) {
+		t.Errorf("unknown file should be deleted")
+	}
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := cache.ReconcileReport(); report != nil || cache.entries.Len() != 2 {
+		t.Errorf("nothing should be reconciled, %+v", report)
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestVerify(t *testing.T) {
+	fmt.Printf("Testing Verify...\n")
+	os.RemoveAll(CACHE_DIR)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000, Checksum: CHECKSUM_CRC32C, UnknownFiles: UNKNOWN_FILES_DELETE}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		writeEntry(t, cache, key, []byte(key+key))
+	}
+	report, err := cache.Verify(context.Background(), VerifyOptions{Checksums: true})
+	if err != nil || !report.OK() || report.Entries != 4 || report.ChecksummedValues != 4 {
+		t.Fatalf("cache should be fine, %+v %v", report, err)
+	}
+	// the tmp file of a running editor is not an orphan
+	editor := cache.Edit("d")
+	writer, _ := editor.CreateOutputStream()
+	writer.Write([]byte("new"))
+	writer.Close()
+	os.WriteFile(cache.entries.Peek("a").GetCleanFilename(), []byte("ab"), 0666)
+	os.Remove(cache.entries.Peek("b").GetCleanFilename())
+	os.WriteFile(cache.entries.Peek("c").GetCleanFilename(), []byte("c"), 0666)
+	orphan := filepath.Join(CACHE_DIR, "e.tmp3")
+	junk := filepath.Join(CACHE_DIR, "junk")
+	os.WriteFile(orphan, []byte("e"), 0666)
+	os.WriteFile(junk, []byte("junk"), 0666)
+	cache.curSize += 7
+
+	report, err = cache.Verify(context.Background(), VerifyOptions{})
+	if err != nil || len(report.ChecksumMismatches) != 0 || report.ChecksummedValues != 0 {
+		t.Errorf("checksums should not be read, %+v %v", report, err)
+	}
+	report, err = cache.Verify(context.Background(), VerifyOptions{Checksums: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string, got []string, want ...string) {
+		t.Helper()
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s should be %v, but %v", name, want, got)
+		}
+	}
+	check("checksum mismatches", report.ChecksumMismatches, "a")
+	check("missing entries", report.MissingEntries, "b")
+	check("size mismatches", report.SizeMismatches, "c")
+	check("orphan files", report.OrphanFiles, orphan)
+	check("unknown files", report.UnknownFiles, junk)
+	if report.OK() || report.CurSize != report.EntriesSize+7 || report.Repaired != 0 {
+		t.Errorf("size error should be found, %+v", report)
+	}
+	if cache.entries.Len() != 4 {
+		t.Errorf("nothing should be repaired")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cache.Verify(ctx, VerifyOptions{Repair: true}); err != context.Canceled {
+		t.Errorf("canceled verify should return context.Canceled, but %v", err)
+	}
+
+	report, err = cache.Verify(context.Background(), VerifyOptions{Checksums: true, Repair: true})
+	if err != nil || report.Repaired != 6 {
+		t.Errorf("6 problems should be repaired, %+v %v", report, err)
+	}
+	if cache.entries.Len() != 1 || cache.curSize != 2 {
+		t.Errorf("only d should be kept, %s of %d bytes", cache.entries.ToString(), cache.curSize)
+	}
+	for _, name := range []string{orphan, junk} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed", name)
+		}
+	}
+	if err := editor.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	report, err = cache.Verify(context.Background(), VerifyOptions{Checksums: true})
+	if err != nil || !report.OK() || report.Entries != 1 {
+		t.Errorf("repaired cache should be fine, %+v %v", report, err)
+	}
+	cache.Close()
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.entries.Len() != 1 || cache.curSize != 3 || cache.ReconcileReport() != nil {
+		t.Errorf("rewritten journal should match the directory, %s %+v", cache.entries.ToString(), cache.ReconcileReport())
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestDirLock(t *testing.T) {
+	fmt.Printf("Testing DirLock...\n")
+	os.RemoveAll(CACHE_DIR)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEntry(t, cache, "a", []byte("a"))
+	if _, err := Open(CACHE_DIR, opts); err != ErrCacheLocked {
+		t.Fatalf("second open should return ErrCacheLocked, but %v", err)
+	}
+	if err := ConvertJournal(CACHE_DIR, JOURNAL_BINARY); err != ErrCacheLocked {
+		t.Errorf("convert an opened cache should return ErrCacheLocked, but %v", err)
+	}
+	opts.LockTimeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := Open(CACHE_DIR, opts); err != ErrCacheLocked || time.Since(start) < opts.LockTimeout {
+		t.Errorf("open should wait %s and fail, but %v after %s", opts.LockTimeout, err, time.Since(start))
+	}
+
+	// the waiting open gets the lock when the cache is closed
+	opts.LockTimeout = 5 * time.Second
+	first := cache
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.Close()
+	}()
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.entries.Len() != 1 || cache.ReconcileReport() != nil {
+		t.Errorf("lock file should not be reconciled, %+v", cache.ReconcileReport())
+	}
+	cache.Close()
+	// a failed open releases the lock
+	opts.AppVersion = 2
+	if _, err := Open(CACHE_DIR, opts); err == nil {
+		t.Fatalf("open of other version should fail")
+	}
+	opts.AppVersion = 1
+	opts.LockTimeout = 0
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestReadOnly(t *testing.T) {
+	fmt.Printf("Testing ReadOnly...\n")
+	os.RemoveAll(CACHE_DIR)
+	clock := &fakeClock{now: time.UnixMilli(1700000000000)}
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000, ShardLevels: 1, Clock: clock}
+	writer, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeEntry(t, writer, "a", []byte("aa"))
+	editor := writer.Edit("b")
+	editor.SetTTL(time.Minute)
+	w, _ := editor.CreateOutputStream()
+	w.Write([]byte("bbb"))
+	w.Close()
+	editor.Commit()
+	writer.Flush()
+	journalName := filepath.Join(CACHE_DIR, JOURNAL_FILENAME)
+	journal, _ := os.ReadFile(journalName)
+
+	// opened while the writer holds the lock, the options of the journal are used
+	readOpts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1, ReadOnly: true, Clock: clock}
+	reader, err := Open(CACHE_DIR, readOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := reader.Stats(); stats.MaxSize != 1000 || stats.Entries != 2 || stats.Size != 5 {
+		t.Errorf("read-only cache should keep the journal, %+v", stats)
+	}
+	snapshot, err := reader.Get("a")
+	if err != nil || snapshot == nil {
+		t.Fatalf("get a failed, %v", err)
+	}
+	if data, _ := io.ReadAll(snapshot.Reader); string(data) != "aa" {
+		t.Errorf("value of a error, %q", data)
+	}
+	snapshot.Close()
+	clock.Add(2 * time.Minute)
+	if snapshot, _ := reader.Get("b"); snapshot != nil || reader.Stats().Entries != 2 {
+		t.Errorf("expired entry should be missed but kept")
+	}
+	if _, err := reader.TryEdit("c"); err != ErrReadOnly {
+		t.Errorf("edit should return ErrReadOnly, but %v", err)
+	}
+	if reader.Edit("c") != nil {
+		t.Errorf("edit should return nil")
+	}
+	if err := reader.Remove("a"); err != ErrReadOnly {
+		t.Errorf("remove should return ErrReadOnly, but %v", err)
+	}
+	if err := reader.RebuildJournal(); err != ErrReadOnly {
+		t.Errorf("rebuild should return ErrReadOnly, but %v", err)
+	}
+	if _, err := reader.Verify(context.Background(), VerifyOptions{Repair: true}); err != ErrReadOnly {
+		t.Errorf("repair should return ErrReadOnly, but %v", err)
+	}
+	if reader.RemoveExpired() != 0 {
+		t.Errorf("expired entries should not be removed")
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(journalName); !bytes.Equal(data, journal) {
+		t.Errorf("read-only cache should not write the journal")
+	}
+
+	readOpts.SharedLock = true
+	if _, err := Open(CACHE_DIR, readOpts); err != ErrCacheLocked {
+		t.Errorf("shared lock should wait the writer, but %v", err)
+	}
+	writer.Close()
+	reader, err = Open(CACHE_DIR, readOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader2, err := Open(CACHE_DIR, readOpts)
+	if err != nil {
+		t.Fatalf("shared locks should be held together, %v", err)
+	}
+	if _, err := Open(CACHE_DIR, opts); err != ErrCacheLocked {
+		t.Errorf("writer should wait the readers, but %v", err)
+	}
+	reader.Close()
+	reader2.Close()
+	lockName := filepath.Join(CACHE_DIR, LOCK_FILENAME)
+	os.Remove(lockName)
+	if _, err := Open(CACHE_DIR, readOpts); err != ErrNoLockFile {
+		t.Errorf("shared lock without lock file should return ErrNoLockFile, but %v", err)
+	}
+	if _, err := os.Stat(lockName); !os.IsNotExist(err) {
+		t.Errorf("shared lock should not create the lock file")
+	}
+
+	// a bad line is only skipped by RECOVERY_TRUNCATE, the journal is not changed
+	journal, _ = os.ReadFile(journalName)
+	bad := append(append([]byte{}, journal...), "bogus a\n"...)
+	os.WriteFile(journalName, bad, 0666)
+	readOpts.SharedLock = false
+	if _, err := Open(CACHE_DIR, readOpts); err == nil {
+		t.Errorf("bad journal should fail")
+	}
+	readOpts.Recovery = RECOVERY_TRUNCATE
+	reader, err = Open(CACHE_DIR, readOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := reader.RecoveryReport(); report == nil || report.DroppedLines != 1 || reader.Stats().Entries != 2 {
+		t.Errorf("bad line should be dropped, %+v", report)
+	}
+	reader.Close()
+	if data, _ := os.ReadFile(journalName); !bytes.Equal(data, bad) {
+		t.Errorf("read-only cache should not recover the journal")
+	}
+	if _, err := Open(filepath.Join(CACHE_DIR, "missing"), readOpts); !os.IsNotExist(err) {
+		t.Errorf("missing cache should not be created, %v", err)
+	}
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestSetMaxSize(t *testing.T) {
+	fmt.Printf("Testing SetMaxSize...\n")
+	os.RemoveAll(CACHE_DIR)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var evicted []string
+	cache.OnEvict(func(e EvictionEvent) {
+		evicted = append(evicted, e.Key)
+	})
+	value := bytes.Repeat([]byte("v"), 100)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		writeEntry(t, cache, key, value)
+	}
+	if _, _, err := cache.SetMaxSize(0); err == nil {
+		t.Errorf("max size 0 should be rejected")
+	}
+	entries, size, err := cache.SetMaxSize(250)
+	if err != nil || entries != 3 || size != 300 || strings.Join(evicted, ",") != "a,b,c" {
+		t.Errorf("a,b,c should be evicted, %d entries %d bytes %v %v", entries, size, evicted, err)
+	}
+	if stats := cache.Stats(); stats.MaxSize != 250 || stats.Size != 200 || stats.Evictions != 3 {
+		t.Errorf("stats error, %+v", stats)
+	}
+	if entries, size, err := cache.SetMaxSize(2000); err != nil || entries != 0 || size != 0 {
+		t.Errorf("growing should evict nothing, %d entries %d bytes %v", entries, size, err)
+	}
+	writeEntry(t, cache, "f", bytes.Repeat([]byte("v"), 1500))
+	cache.SetMaxSize(1600)
+	scanner, err := OpenJournal(CACHE_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := scanner.Header(); header.MaxSize != 1600 {
+		t.Errorf("max size of journal should be 1600, but %d", header.MaxSize)
+	}
+	scanner.Close()
+	cache.Close()
+
+	// the size kept by the journal is not rebuilt by a cache of the same size
+	opts.MaxSize = 1600
+	backup, _ := os.Stat(filepath.Join(CACHE_DIR, JOURNAL_BACKUP_FILE))
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Size != 1600 {
+		t.Errorf("entries should be kept, %+v", stats)
+	}
+	if info, _ := os.Stat(filepath.Join(CACHE_DIR, JOURNAL_BACKUP_FILE)); !info.ModTime().Equal(backup.ModTime()) {
+		t.Errorf("journal should not be rebuilt")
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	fmt.Printf("Testing EvictionPolicies...\n")
+	checkVictim := func(name string, policy EvictionPolicy, expect string) {
+		t.Helper()
+		if key, ok := policy.Victim(nil); !ok || key != expect {
+			t.Errorf("%s victim should be %s, but %q", name, expect, key)
+		}
+	}
+	lru := NewLRUPolicy()
+	for _, key := range []string{"a", "b", "c"} {
+		lru.OnInsert(key, 100)
+	}
+	lru.OnAccess("a")
+	checkVictim("lru", lru, "b")
+
+	lfu := NewLFUPolicy()
+	lfu.OnInsert("a", 100)
+	lfu.OnInsert("b", 100)
+	lfu.OnAccess("a")
+	checkVictim("lfu", lfu, "b")
+	lfu.OnAccess("b")
+	lfu.OnAccess("b")
+	checkVictim("lfu", lfu, "a")
+	lfu.OnRemove("a")
+	checkVictim("lfu", lfu, "b")
+
+	slru := NewSLRUPolicy(0.5)
+	slru.SetMaxSize(300)
+	for _, key := range []string{"a", "b", "c"} {
+		slru.OnInsert(key, 100)
+	}
+	slru.OnAccess("a")
+	checkVictim("slru", slru, "b")
+	// protected is full, a is demoted behind c
+	slru.OnAccess("b")
+	checkVictim("slru", slru, "c")
+	if slru.EntryState("b") != "protected" || slru.EntryState("a") != "" {
+		t.Errorf("slru states error")
+	}
+
+	arc := NewARCPolicy()
+	arc.SetMaxSize(300)
+	for _, key := range []string{"a", "b", "c"} {
+		arc.OnInsert(key, 100)
+	}
+	checkVictim("arc", arc, "a")
+	arc.OnAccess("a")
+	checkVictim("arc", arc, "b")
+	arc.OnRemove("b")
+	// b is a ghost of t1, so t1 grows and the victim comes from t2
+	arc.OnInsert("b", 100)
+	if arc.target != 100 || arc.EntryState("b") != "t2:100" {
+		t.Errorf("arc target should be 100 with b in t2, but %d %s", arc.target, arc.EntryState("b"))
+	}
+	checkVictim("arc", arc, "a")
+
+	tinyLFU := NewTinyLFUPolicy(0.1)
+	tinyLFU.SetMaxSize(1000)
+	for i := 1; i <= 10; i++ {
+		tinyLFU.OnInsert(fmt.Sprintf("k%d", i), 100)
+	}
+	if tinyLFU.EntryState("k10") != "window:1" || tinyLFU.EntryState("k1") != "probation:1" {
+		t.Errorf("tinylfu states error, %s %s", tinyLFU.EntryState("k10"), tinyLFU.EntryState("k1"))
+	}
+	// the candidate leaving the window is not used more than the main victim
+	tinyLFU.OnInsert("x", 100)
+	checkVictim("tinylfu", tinyLFU, "k10")
+	tinyLFU.OnRemove("k10")
+	tinyLFU.OnAccess("x")
+	tinyLFU.OnInsert("y", 100)
+	checkVictim("tinylfu", tinyLFU, "k1")
+	tinyLFU.OnRemove("k1")
+	if state := tinyLFU.EntryState("x"); state != "probation:2" {
+		t.Errorf("x should be admitted, but %s", state)
+	}
+}
+
+func TestEvictionPolicyJournal(t *testing.T) {
+	fmt.Printf("Testing EvictionPolicyJournal...\n")
+	os.RemoveAll(CACHE_DIR)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 300, EvictionPolicy: NewLFUPolicy()}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("v"), 100)
+	for _, key := range []string{"a", "b", "c"} {
+		writeEntry(t, cache, key, value)
+	}
+	for _, key := range []string{"c", "a", "a", "b"} {
+		snapshot, _ := cache.Get(key)
+		snapshot.Close()
+	}
+	// the least recently used c is kept, the new entry is used less
+	writeEntry(t, cache, "d", value)
+	if snapshot, _ := cache.Get("d"); snapshot != nil || cache.Stats().Entries != 3 {
+		t.Errorf("d should be evicted")
+	}
+	cache.RebuildJournal()
+	cache.Close()
+
+	scanner, err := OpenJournal(CACHE_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanner.Header().Policy != "lfu" {
+		t.Errorf("journal policy should be lfu, but %q", scanner.Header().Policy)
+	}
+	states := make(map[string]string)
+	for record, err := scanner.Next(); err == nil; record, err = scanner.Next() {
+		states[record.Key] = record.PolicyState
+	}
+	scanner.Close()
+	if states["a"] != "3" || states["b"] != "2" || states["c"] != "2" {
+		t.Errorf("journal states error, %v", states)
+	}
+
+	opts.EvictionPolicy = NewLFUPolicy()
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, _ := cache.Get("b")
+	snapshot.Close()
+	cache.Close()
+	// the read after the rebuild is replayed
+	policy := NewLFUPolicy()
+	opts.EvictionPolicy = policy
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.freqs["a"] != 3 || policy.freqs["b"] != 3 || policy.freqs["c"] != 2 {
+		t.Errorf("lfu frequencies should be restored, but %v", policy.freqs)
+	}
+	cache.Close()
+
+	// another policy starts from the LRU order
+	arc := NewARCPolicy()
+	opts.EvictionPolicy = arc
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := arc.Victim(nil); key != "c" || cache.Stats().Entries != 3 {
+		t.Errorf("arc should evict c first, but %s", key)
+	}
+	cache.Close()
+	scanner, _ = OpenJournal(CACHE_DIR)
+	if scanner.Header().Policy != "arc" {
+		t.Errorf("journal should be rebuilt for arc, but %q", scanner.Header().Policy)
+	}
+	scanner.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestAdmission(t *testing.T) {
+	fmt.Printf("Testing Admission...\n")
+	os.RemoveAll(CACHE_DIR)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 300, Admission: NewFrequencyFilter(0)}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("v"), 100)
+	commit := func(key string) error {
+		editor := cache.Edit(key)
+		writer, _ := editor.CreateOutputStream()
+		writer.Write(value)
+		writer.Close()
+		return editor.Commit()
+	}
+	get := func(key string) bool {
+		snapshot, _ := cache.Get(key)
+		if snapshot != nil {
+			snapshot.Close()
+		}
+		return snapshot != nil
+	}
+	// admitted while the cache has room
+	for _, key := range []string{"a", "b", "c"} {
+		if err := commit(key); err != nil {
+			t.Fatal(err)
+		}
+		get(key)
+		get(key)
+	}
+	if err := commit("d"); err != ErrNotAdmitted {
+		t.Errorf("d used once should not be admitted, but %v", err)
+	}
+	if get("d") || !get("a") || cache.Stats().Rejections != 1 {
+		t.Errorf("d should be rejected and a kept, %+v", cache.Stats())
+	}
+	if _, err := os.Stat(filepath.Join(CACHE_DIR, "d")); !os.IsNotExist(err) {
+		t.Errorf("file of rejected d should be removed")
+	}
+	for i := 0; i < 3; i++ {
+		get("d")
+	}
+	// d is used more than the victim b now
+	if err := commit("d"); err != nil || !get("d") || get("b") {
+		t.Errorf("d should replace b, %v", err)
+	}
+	// a replaced value is always admitted
+	if err := commit("c"); err != nil || !get("c") {
+		t.Errorf("c should be replaced, %v", err)
+	}
+	cache.Close()
+
+	opts.Admission = NewFrequencyFilter(0)
+	opts.DiscardNotAdmitted = true
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the new filter has not seen the entries yet
+	for _, info := range cache.Entries() {
+		get(info.Key)
+	}
+	if err := commit("e"); err != nil || get("e") {
+		t.Errorf("e should be discarded silently, %v", err)
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestCostPolicy(t *testing.T) {
+	fmt.Printf("Testing CostPolicy...\n")
+	gds := NewGreedyDualSizePolicy()
+	gds.OnInsertCost("big", 1000, 10)
+	gds.OnInsertCost("small", 10, 10)
+	if key, _ := gds.Victim(nil); key != "big" {
+		t.Errorf("big should be evicted first, but %s", key)
+	}
+	gds.OnRemove("big")
+	gds.OnInsertCost("cheap", 10, 1)
+	if key, _ := gds.Victim(nil); key != "cheap" || gds.inflation != 0.01 {
+		t.Errorf("cheap should be evicted first, but %s, inflation %v", key, gds.inflation)
+	}
+
+	os.RemoveAll(CACHE_DIR)
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000, EvictionPolicy: NewGreedyDualSizePolicy()}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(key string, size int, cost float64) {
+		editor := cache.Edit(key)
+		editor.SetCost(cost)
+		writer, _ := editor.CreateOutputStream()
+		writer.Write(bytes.Repeat([]byte("v"), size))
+		writer.Close()
+		if err := editor.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit("small", 100, 50)
+	commit("huge", 800, 10)
+	commit("mid", 200, 20)
+	// the cheapest byte goes first, not the least recently used
+	if snapshot, _ := cache.Get("huge"); snapshot != nil {
+		snapshot.Close()
+		t.Errorf("huge should be evicted")
+	}
+	cache.RebuildJournal()
+	cache.Close()
+
+	policy := NewGreedyDualSizePolicy()
+	opts.EvictionPolicy = policy
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := cache.Entries()
+	if len(entries) != 2 || entries[0].Key != "small" || entries[0].Cost != 50 {
+		t.Errorf("cost should be kept, %+v", entries)
+	}
+	if policy.inflation != 0.0125 || policy.items["small"].priority != 0.5 || policy.items["mid"].priority != 0.1 {
+		t.Errorf("priorities should be restored, inflation %v", policy.inflation)
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestPin(t *testing.T) {
+	fmt.Printf("Testing Pin...\n")
+	os.RemoveAll(CACHE_DIR)
+	cache, err := Open(CACHE_DIR, Options{AppVersion: 1, CacheVersion: 1, MaxSize: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("v"), 100)
+	exists := func(key string) bool {
+		snapshot, _ := cache.Get(key)
+		if snapshot != nil {
+			snapshot.Close()
+		}
+		return snapshot != nil
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		writeEntry(t, cache, key, value)
+	}
+	if ok, err := cache.Pin("a"); !ok || err != nil {
+		t.Fatalf("pin a failed, %v", err)
+	}
+	cache.Pin("a")
+	if ok, _ := cache.Pin("missing"); ok {
+		t.Errorf("missing key should not be pinned")
+	}
+	if stats := cache.Stats(); stats.PinnedSize != 100 || stats.PinnedEntries != 1 {
+		t.Errorf("pinned stats error, %+v", stats)
+	}
+	cache.Remove("b")
+	writeEntry(t, cache, "b", value)
+	// a is the least recently used, but c goes
+	writeEntry(t, cache, "d", value)
+	if !exists("a") || exists("c") {
+		t.Errorf("pinned a should be kept and c evicted")
+	}
+	cache.Unpin("a")
+	cache.Pin("b")
+	cache.Pin("d")
+	// only the new entry can be evicted
+	writeEntry(t, cache, "e", value)
+	if exists("e") || cache.Stats().Size != 300 {
+		t.Errorf("e should be evicted, %+v", cache.Stats())
+	}
+	editor := cache.Edit("a")
+	writer, _ := editor.CreateOutputStream()
+	writer.Write(bytes.Repeat([]byte("v"), 200))
+	writer.Close()
+	var pinnedErr *PinnedSizeError
+	if err := editor.Commit(); !errors.As(err, &pinnedErr) || pinnedErr.PinnedSize != 400 {
+		t.Errorf("commit over pinned size should fail, but %v", err)
+	}
+	// Edit moves a to the tail
+	if entries := cache.Entries(); len(entries) != 3 || entries[2].Key != "a" || entries[2].Size != 100 || entries[2].Pins != 1 {
+		t.Errorf("a should keep the old value, %+v", entries)
+	}
+	// the last unpin makes a evictable again
+	if err := cache.Unpin("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Unpin("a"); err == nil {
+		t.Errorf("unpin of unpinned a should fail")
+	}
+	writeEntry(t, cache, "f", value)
+	if exists("a") || !exists("f") {
+		t.Errorf("a should be evicted after unpinned")
+	}
+	cache.Remove("d")
+	if stats := cache.Stats(); stats.PinnedSize != 100 || stats.PinnedEntries != 1 {
+		t.Errorf("removed d should not be pinned, %+v", stats)
+	}
+	cache.Close()
+
+	// a policy keeps the state of a pinned entry and skips it when choosing the victim
+	has := func(key string) bool {
+		for _, info := range cache.Entries() {
+			if info.Key == key {
+				return true
+			}
+		}
+		return false
+	}
+	open := func(policy EvictionPolicy) {
+		os.RemoveAll(CACHE_DIR)
+		cache, err = Open(CACHE_DIR, Options{AppVersion: 1, CacheVersion: 1, MaxSize: 300, EvictionPolicy: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"a", "b", "c"} {
+			writeEntry(t, cache, key, value)
+		}
+	}
+	checkVictim := func(name string, policy EvictionPolicy, expect string) {
+		t.Helper()
+		if key, _ := policy.Victim(nil); key != expect {
+			t.Errorf("%s victim should be %s, but %s", name, expect, key)
+		}
+	}
+	lfu := NewLFUPolicy()
+	open(lfu)
+	for i := 0; i < 5; i++ {
+		exists("a")
+	}
+	cache.Pin("a")
+	cache.Unpin("a")
+	if lfu.freqs["a"] != 6 {
+		t.Errorf("lfu frequency of a should be kept, but %d", lfu.freqs["a"])
+	}
+	checkVictim("lfu", lfu, "b")
+	cache.Pin("b")
+	writeEntry(t, cache, "d", value)
+	if !has("a") || !has("b") || has("c") {
+		t.Errorf("lfu should skip pinned b and evict c, %+v", cache.Entries())
+	}
+	cache.Unpin("b")
+	checkVictim("lfu", lfu, "b")
+	cache.Close()
+
+	arc := NewARCPolicy()
+	open(arc)
+	cache.Pin("a")
+	cache.Unpin("a")
+	if arc.target != 0 || !arc.t1.has("a") || arc.b1.len() != 0 {
+		t.Errorf("arc should keep a in t1, target %d", arc.target)
+	}
+	checkVictim("arc", arc, "a")
+	cache.Pin("a")
+	writeEntry(t, cache, "d", value)
+	if !has("a") || has("b") {
+		t.Errorf("arc should skip pinned a and evict b, %+v", cache.Entries())
+	}
+	cache.Unpin("a")
+	checkVictim("arc", arc, "a")
+	cache.Close()
+
+	gds := NewGreedyDualSizePolicy()
+	open(gds)
+	cache.Pin("a")
+	cache.Unpin("a")
+	if gds.inflation != 0 {
+		t.Errorf("pin should not raise the gds inflation, but %v", gds.inflation)
+	}
+	cache.Pin("a")
+	writeEntry(t, cache, "d", value)
+	if !has("a") || has("b") || gds.inflation != 0.01 {
+		t.Errorf("gds should skip pinned a and evict b, inflation %v, %+v", gds.inflation, cache.Entries())
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
+
+func TestMaxEntries(t *testing.T) {
+	fmt.Printf("Testing MaxEntries...\n")
+	os.RemoveAll(CACHE_DIR)
+	if _, err := Open(CACHE_DIR, Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000, MaxEntries: -1}); err == nil {
+		t.Errorf("negative max entries should be rejected")
+	}
+	opts := Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000, MaxEntries: 3}
+	cache, err := Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		writeEntry(t, cache, key, []byte(key))
+	}
+	if stats := cache.Stats(); stats.Entries != 3 || stats.MaxEntries != 3 || stats.Evictions != 1 {
+		t.Errorf("a should be evicted by count, %+v", stats)
+	}
+	if snapshot, _ := cache.Get("a"); snapshot != nil {
+		snapshot.Close()
+		t.Errorf("a should be evicted")
+	}
+	cache.Close()
+	scanner, err := OpenJournal(CACHE_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := scanner.Header(); header.MaxEntries != 3 {
+		t.Errorf("max entries of journal should be 3, but %d", header.MaxEntries)
+	}
+	scanner.Close()
+
+	// a smaller limit is applied when opened
+	opts.MaxEntries = 2
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := cache.Entries(); len(entries) != 2 || entries[0].Key != "c" {
+		t.Errorf("b should be evicted, %+v", entries)
+	}
+	cache.Close()
+	// read-only takes the limit of the journal
+	cache, err = Open(CACHE_DIR, Options{AppVersion: 1, CacheVersion: 1, MaxSize: 1000, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.Stats(); stats.MaxEntries != 2 {
+		t.Errorf("read-only max entries should be 2, but %d", stats.MaxEntries)
+	}
+	cache.Close()
+
+	// a new entry being edited is not counted and not evicted
+	os.RemoveAll(CACHE_DIR)
+	opts.MaxEntries = 1
+	cache, err = Open(CACHE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editor := cache.Edit("b")
+	writeEntry(t, cache, "c", []byte("c"))
+	if entries := cache.Entries(); len(entries) != 2 {
+		t.Errorf("b being edited should be kept, %+v", entries)
+	}
+	w, _ := editor.CreateOutputStream()
+	w.Write([]byte("b"))
+	w.Close()
+	if err := editor.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// b is edited before c, so it is the least recently used when commited
+	if entries := cache.Entries(); len(entries) != 1 || entries[0].Key != "c" || cache.Stats().Evictions != 1 {
+		t.Errorf("b should be evicted after its commit, %+v", entries)
+	}
+	// the commit of an entry evicted while being edited fails
+	editor = cache.Edit("c")
+	writeEntry(t, cache, "d", []byte("d"))
+	w, _ = editor.CreateOutputStream()
+	w.Write([]byte("cc"))
+	w.Close()
+	if err := editor.Commit(); err != ErrEntryEvicted {
+		t.Errorf("commit of evicted c should return ErrEntryEvicted, but %v", err)
+	}
+	if entries := cache.Entries(); len(entries) != 1 || entries[0].Key != "d" {
+		t.Errorf("only d should be kept, %+v", entries)
+	}
+	cache.Close()
+	os.RemoveAll(CACHE_DIR)
+}
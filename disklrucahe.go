@@ -3,14 +3,12 @@ package disklrucache
 import (
 	"bufio"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
-	"path"
 	"path/filepath"
 	"runtime"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
@@ -28,21 +26,54 @@ const (
 )
 
 type CacheEntry struct {
-	base      *DiskLRUCache
-	key       string
-	size      int64 //file size
-	readable  bool
-	commitId  uint32
-	curEditor *DiskLRUCacheEditor
-	time      time.Time
+	base       *DiskLRUCache
+	key        string
+	filename   string  //mapped from key by KeyMapper
+	dir        string  //shard directory relative to cache path
+	size       int64   //total file size
+	sizes      []int64 //file size of each value
+	readable   bool
+	commitId   uint32
+	curEditor  *DiskLRUCacheEditor
+	time       time.Time
+	accessTime time.Time //last read, not saved in journal
+	meta       entryMeta
+
+	policyState string //read from journal, handed to the policy when opened
+	replayReads int    //read records after the last clean record
+	pins        int    //taken by Pin, a pinned entry is not evicted but still tracked by the policy
 }
 
 func (entry *CacheEntry) GetDirtyFilename() string {
-	return getAvailableTmpFilename(entry.GetCleanFilename())
+	return entry.GetDirtyFilenameAt(0)
 }
 
 func (entry *CacheEntry) GetCleanFilename() string {
-	return path.Join(entry.base.cachePath, entry.key)
+	return entry.GetCleanFilenameAt(0)
+}
+
+func (entry *CacheEntry) GetDirtyFilenameAt(index int) string {
+	return getAvailableTmpFilename(entry.GetCleanFilenameAt(index))
+}
+
+// the file of a single value cache is named by key, or key.index for multi values
+func (entry *CacheEntry) GetCleanFilenameAt(index int) string {
+	return entry.base.valueFilename(entry.dir, entry.filename, index)
+}
+
+func (entry *CacheEntry) removeFiles() {
+	for i := 0; i < entry.base.valueCount; i++ {
+		os.Remove(entry.GetCleanFilenameAt(i))
+	}
+	entry.removeEmptyDirs()
+}
+
+func (entry *CacheEntry) setSizes(sizes []int64) {
+	entry.sizes = sizes
+	entry.size = 0
+	for _, size := range sizes {
+		entry.size += size
+	}
 }
 
 type DiskLRUCache struct {
@@ -53,18 +84,95 @@ type DiskLRUCache struct {
 	sequential_id uint32 //begin from 1
 	cachePath     string
 	maxSize       int64
+	maxEntries    int //0 if not limited
+	newEntries    int //entries being edited which are never commited, not counted by maxEntries
 	curSize       int64
+	valueCount    int
+	shardLevels   int
+	keyMapper     KeyMapper
+	policy        EvictionPolicy //nil evicts by the order of entries
 	journalFile   *os.File
+	journalWriter *bufio.Writer
+	journalFormat JournalFormat
+	dirLock       *os.File //held until Close
+	lockTimeout   time.Duration
+	readOnly      bool
+	sharedLock    bool
+	closed        bool
+	fileMode      os.FileMode
+	dirMode       os.FileMode
+	logger        Logger
+	clock         Clock
+
+	admission          AdmissionFilter //nil admits every key
+	discardNotAdmitted bool
+	pinnedSize         int64 //bytes of pinned entries, included in curSize
+	pinnedEntries      int64
+
+	recoveryPolicy RecoveryPolicy
+	recoveryReport *RecoveryReport
+
+	unknownFiles    UnknownFilePolicy
+	reconcileReport *ReconcileReport
+
+	stopBackground   chan struct{} //closed to stop the sweeper and compactor
+	background       sync.WaitGroup
+	compactThreshold int
+	compactWake      chan struct{}
+	compactTail      []string   //records written while compacting, nil if not compacting
+	rebuildLock      sync.Mutex //only one journal rewrite at a time
+
+	journalBufferSize int
+	flushEachRecord   bool
+
+	durability Durability
+	checksum   ChecksumType
+	syncLock   sync.Mutex //held by the goroutine syncing for all
+	journalSeq uint64     //records ever written, never reset
+	syncedSeq  uint64     //records known durable, guarded by syncLock
+	syncFiles  []string   //value files commited since last sync in periodic mode
+	syncDirSet map[string]struct{}
+
+	stats          cacheStats
+	journalRecords int64 //record lines in journal, used to know the redundant ones
+
+	evictListeners   []func(EvictionEvent)
+	pendingEvictions []*EvictionEvent //delivered when the lock is released
 }
 
 type DiskLRUCacheEditor struct {
-	base        *DiskLRUCache
-	entry       *CacheEntry
-	lock        sync.RWMutex
-	isError     bool
-	commited    bool
-	writeSize   int64
-	tmpFilename string
+	base         *DiskLRUCache
+	entry        *CacheEntry
+	lock         sync.RWMutex
+	locked       bool // lock is taken by a stream and released by Commit or Abort
+	isError      bool
+	commited     bool
+	aborted      bool
+	evicted      bool // the entry is evicted while editing, Commit fails
+	writeSize    int64
+	tmpFilenames []string    // empty if the value is not written
+	prevTime     time.Time   // entry time before edit, restored by Abort
+	meta         entryMeta   // replace the metadata of entry when commit
+	hashes       []hash.Hash // hash of each value written from the start, nil if it must be read again
+	hashedSizes  []int64
+	sums         [][]byte // computed by Commit before the cache lock is taken
+}
+
+// the entry expires at t after commit, zero time means never expire.
+// an entry commited without expiry never expires even if the old value has one
+func (editor *DiskLRUCacheEditor) SetExpiry(t time.Time) {
+	editor.meta.expiry = t
+}
+
+// the entry expires ttl after now
+func (editor *DiskLRUCacheEditor) SetTTL(ttl time.Duration) {
+	editor.meta.expiry = editor.base.clock.Now().Add(ttl)
+}
+
+// cost to produce the value again, like the fetch latency in ms, weighed by a CostPolicy.
+// 0 is DEFAULT_COST, a commit without cost resets the cost of the old value
+func (editor *DiskLRUCacheEditor) SetCost(cost float64) {
+	editor.meta.cost = max(cost, 0)
 }
 
 // get the size that have written,do not care overlap
@@ -72,196 +180,483 @@ func (editor *DiskLRUCacheEditor) WriteSize() int64 {
 	return editor.writeSize
 }
 
-// get the true filesize
+// get the true filesize of all written values
 func (editor *DiskLRUCacheEditor) FileSize() int64 {
-	info, err := os.Stat(editor.tmpFilename)
-	if err != nil {
-		return 0
+	size := int64(0)
+	for _, name := range editor.tmpFilenames {
+		size += fileSize(name)
 	}
-	return info.Size()
+	return size
 }
 func (editor *DiskLRUCacheEditor) maxSize() int64 {
 	return editor.entry.base.maxSize
 }
 
+func (entry *CacheEntry) cleanLine() string {
+	return encodeRecord(entry.base.journalFormat, entry.cleanRecord())
+}
+
+func (entry *CacheEntry) expired(now time.Time) bool {
+	return !entry.meta.expiry.IsZero() && !now.Before(entry.meta.expiry)
+}
+
 func (cache *DiskLRUCache) checkNotClosed() {
-	if cache.journalFile == nil {
+	if cache.closed || cache.journalFile == nil && !cache.readOnly {
 		panic("cache journal file is closed")
 	}
 }
 
 // need lock manually
 func (cache *DiskLRUCache) checkFull() {
-	for cache.curSize > cache.maxSize {
-		entry := cache.entries.Pop()
+	for cache.curSize > cache.maxSize || cache.overMaxEntries(0) {
+		entry := cache.popVictim()
+		if entry == nil {
+			break
+		}
+		cache.evict(entry, EVICT_CAPACITY)
 		if entry.curEditor != nil {
-			log.Println("warning: a uncommited entry is popped,may be cache size is too small")
+			cache.logger.Printf("warning: a uncommited entry is popped,may be cache size is too small")
+			entry.curEditor.evicted = true
 			entry.curEditor = nil
 		}
-		os.Remove(entry.GetCleanFilename())
-		if entry.size == 0 {
-			log.Panicf("fatal error, entry size is 0, key:%s", entry.key)
-		}
+		entry.removeFiles()
 		cache.curSize -= entry.size
-		cache.journalFile.WriteString(
-			fmt.Sprintf("%s %s\n", DEL, entry.key),
-		)
+		cache.stats.evictions.Add(1)
+		cache.stats.evictionBytes.Add(entry.size)
+		cache.writeJournal(cache.keyLine(DEL, entry.key))
 	}
 }
 
+// return true if the commited entries and adding new ones are more than maxEntries, need lock manually
+func (cache *DiskLRUCache) overMaxEntries(adding int) bool {
+	return cache.maxEntries > 0 && cache.entries.Len()-cache.newEntries+adding > cache.maxEntries
+}
+
+// need lock manually
+func (cache *DiskLRUCache) writeJournal(line string) error {
+	if cache.readOnly {
+		return ErrReadOnly
+	}
+	var err error
+	if len(line) > cache.journalWriter.Available() && cache.journalWriter.Buffered() > 0 {
+		// a full buffer would flush in the middle of the record, readers of a live journal see it torn
+		err = cache.journalWriter.Flush()
+	}
+	if err == nil {
+		_, err = cache.journalWriter.WriteString(line)
+	}
+	if err == nil && cache.flushEachRecord {
+		err = cache.journalWriter.Flush()
+	}
+	cache.journalRecords++
+	cache.journalSeq++
+	if cache.compactTail != nil {
+		cache.compactTail = append(cache.compactTail, line)
+	} else if cache.compactRequired() {
+		select {
+		case cache.compactWake <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// return nil if the key is invalid or the entry is being edited, use TryEdit to know why
 func (cache *DiskLRUCache) Edit(name string) *DiskLRUCacheEditor {
-	cache.checkNotClosed()
+	editor, _ := cache.TryEdit(name)
+	return editor
+}
+
+// like Edit, but return InvalidKeyError or ErrEntryEditing instead of nil editor
+func (cache *DiskLRUCache) TryEdit(name string) (*DiskLRUCacheEditor, error) {
+	filename, err := cache.keyFilename(name)
+	if err != nil {
+		return nil, err
+	}
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
+	cache.checkNotClosed()
+	if cache.readOnly {
+		return nil, ErrReadOnly
+	}
 	entry := cache.entries.Get(name)
 	// insert new entry if not exist
 	if entry == nil {
 		node := cache.entries.Set(name, CacheEntry{
 			base:      cache,
 			key:       name,
+			filename:  filename,
+			dir:       shardDir(name, cache.shardLevels),
 			size:      0,
 			readable:  false,
 			commitId:  0,
 			curEditor: nil,
 		})
 		entry = &node.val
+		cache.newEntries++
 	}
 	//do not change readable status for that snapshot should not stuck by write
 	if entry.curEditor != nil {
-		return nil
+		return nil, ErrEntryEditing
 	}
-	editor := &DiskLRUCacheEditor{base: cache, entry: entry, lock: sync.RWMutex{}, isError: false, commited: false, writeSize: 0, tmpFilename: ""}
+	editor := &DiskLRUCacheEditor{base: cache, entry: entry, lock: sync.RWMutex{}, isError: false, commited: false, writeSize: 0,
+		tmpFilenames: make([]string, cache.valueCount), prevTime: entry.time,
+		hashes: make([]hash.Hash, cache.valueCount), hashedSizes: make([]int64, cache.valueCount)}
 	entry.curEditor = editor
-	entry.time = time.Now()
-	cache.journalFile.WriteString(
-		fmt.Sprintf("%s %s\n", DIRTY, name),
-	)
-	return editor
+	entry.time = cache.clock.Now()
+	cache.stats.puts.Add(1)
+	// flush before the files are created, so they are known by the journal
+	if err := firstError(cache.writeJournal(cache.keyLine(DIRTY, name)), cache.flushJournal()); err != nil {
+		cache.logger.Printf("warning: write journal failed,err:%s", err)
+	}
+	return editor, nil
 }
 
 // Will remove anyway, even if editor is not commited
-func (cache *DiskLRUCache) Remove(name string) {
-	cache.checkNotClosed()
+func (cache *DiskLRUCache) Remove(name string) error {
+	if _, err := cache.keyFilename(name); err != nil {
+		return err
+	}
 	cache.lock.Lock()
-	defer cache.lock.Unlock()
+	defer cache.unlockAndNotify()
+	cache.checkNotClosed()
+	if cache.readOnly {
+		return ErrReadOnly
+	}
+	if cache.entries.Peek(name) != nil {
+		cache.stats.removals.Add(1)
+	}
+	return cache.removeEntry(name, EVICT_REMOVED)
+}
+
+// need lock manually
+func (cache *DiskLRUCache) removeEntry(name string, reason EvictReason) error {
 	entry := cache.entries.Del(name)
 	if entry == nil {
-		return
+		return nil
 	}
+	if entry.commitId == 0 {
+		cache.newEntries--
+	}
+	cache.policyRemove(name)
+	cache.dropPins(entry)
+	cache.evict(entry, reason)
 	entry.curEditor = nil
 	//only remove clean file, dirty file will be removed when commit
-	os.Remove(entry.GetCleanFilename())
+	entry.removeFiles()
 	cache.curSize -= entry.size
-	cache.journalFile.WriteString(
-		fmt.Sprintf("%s %s\n", DEL, name),
-	)
+	return cache.writeJournal(cache.keyLine(DEL, name))
 }
 
-// will return a output stream, which will record write num
-func (editor *DiskLRUCacheEditor) CreateOutputStream() (io.WriteCloser, error) {
-	editor.lock.Lock()
-	editor.tmpFilename = editor.entry.GetDirtyFilename()
-	file, err := os.OpenFile(editor.tmpFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
-	if err != nil {
-		editor.isError = true
+// take the editor lock for a stream, it is kept until Commit or Abort
+func (editor *DiskLRUCacheEditor) lockStream(index int) error {
+	if editor.commited || editor.aborted {
+		return NewIllegalStateError("editor is already commited or aborted")
+	}
+	if index < 0 || index >= len(editor.tmpFilenames) {
+		return NewIllegalArgumentError(fmt.Sprintf("value index %d out of range [0,%d)", index, len(editor.tmpFilenames)))
 	}
-	return &EditorWriter{file: file, editor: editor}, err
+	if !editor.locked {
+		editor.lock.Lock()
+		editor.locked = true
+	}
+	if editor.tmpFilenames[index] == "" {
+		editor.tmpFilenames[index] = editor.entry.GetDirtyFilenameAt(index)
+	}
+	return nil
 }
 
-func (editor *DiskLRUCacheEditor) CreateAppendStream() (io.WriteCloser, error) {
-	editor.lock.Lock()
-	if editor.tmpFilename == "" {
-		editor.tmpFilename = editor.entry.GetDirtyFilename()
+func (editor *DiskLRUCacheEditor) unlockStream() {
+	if editor.locked {
+		editor.locked = false
+		editor.lock.Unlock()
+	}
+}
+
+func (editor *DiskLRUCacheEditor) openStream(index int, flag int) (*EditorWriter, error) {
+	if err := editor.lockStream(index); err != nil {
+		return nil, err
+	}
+	var file *os.File
+	var err error
+	// the shard directory may be removed by eviction of other entries before the file is created
+	for retry := 0; retry < 3; retry++ {
+		if err = editor.entry.makeDir(); err != nil {
+			break
+		}
+		file, err = os.OpenFile(editor.tmpFilenames[index], flag, editor.base.fileMode)
+		if !os.IsNotExist(err) {
+			break
+		}
 	}
-	file, err := os.OpenFile(editor.tmpFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
 	if err != nil {
 		editor.isError = true
+	} else {
+		editor.resetHash(index, flag)
 	}
-	return &EditorWriter{file: file, editor: editor}, err
+	return &EditorWriter{file: file, editor: editor, index: index}, err
+}
+
+// will return a output stream of value 0, which will record write num
+func (editor *DiskLRUCacheEditor) CreateOutputStream() (io.WriteCloser, error) {
+	return editor.NewOutputStream(0)
+}
+
+func (editor *DiskLRUCacheEditor) CreateAppendStream() (io.WriteCloser, error) {
+	return editor.openStream(0, os.O_CREATE|os.O_APPEND|os.O_WRONLY)
 }
 func (editor *DiskLRUCacheEditor) CreateRandomWriter() (*EditorWriter, error) {
-	editor.lock.Lock()
-	editor.tmpFilename = editor.entry.GetDirtyFilename()
-	file, err := os.OpenFile(editor.tmpFilename, os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		editor.isError = true
+	return editor.openStream(0, os.O_CREATE|os.O_WRONLY)
+}
+
+// will return a output stream of the value at index, the old content is truncated
+func (editor *DiskLRUCacheEditor) NewOutputStream(index int) (io.WriteCloser, error) {
+	w, err := editor.openStream(index, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if w == nil {
+		return nil, err
 	}
-	return &EditorWriter{file: file, editor: editor}, err
+	return w, err
 }
 
 // Would Not lock
 func (editor *DiskLRUCacheEditor) CreateInputStream() (io.ReadCloser, error) {
+	return editor.NewInputStream(0)
+}
+
+// read the last commited value at index, return nil if the entry is never commited
+func (editor *DiskLRUCacheEditor) NewInputStream(index int) (io.ReadCloser, error) {
 	if editor.entry.readable == false {
 		return nil, nil
 	}
-	if runtime.GOOS == "windows" {
-		tmpName := getAvailableLinkname(editor.entry.GetCleanFilename())
-		err := os.Link(editor.entry.GetCleanFilename(), tmpName)
-		if err != nil {
-			return nil, err
-		}
-		file, err := os.OpenFile(tmpName, os.O_RDONLY, 0666)
-		if err != nil {
-			return nil, err
-		}
-		return &AutoRemoveReader{File: file}, nil
+	if index < 0 || index >= editor.base.valueCount {
+		return nil, NewIllegalArgumentError(fmt.Sprintf("value index %d out of range [0,%d)", index, editor.base.valueCount))
 	}
-	file, err := os.OpenFile(editor.entry.key, os.O_RDONLY, 0666)
-	return file, err
+	return openReader(editor.entry.GetCleanFilenameAt(index))
 }
 
 func (editor *DiskLRUCacheEditor) Commit() error {
-	defer editor.lock.Unlock()
+	if err := firstError(editor.sumValues(), editor.syncTmpFiles()); err != nil {
+		editor.Abort()
+		return err
+	}
+	seq, err := editor.commit()
+	if err == nil && seq > 0 {
+		err = editor.base.syncUpTo(seq)
+	}
+	return err
+}
+
+// return the journal record to sync in group mode
+func (editor *DiskLRUCacheEditor) commit() (uint64, error) {
 	editor.base.lock.Lock()
-	defer editor.base.lock.Unlock()
+	defer editor.base.unlockAndNotify()
+	defer editor.unlockStream()
 
+	if editor.commited || editor.aborted {
+		return 0, NewIllegalStateError("editor is already commited or aborted")
+	}
 	if editor.entry.curEditor != editor {
 		//remove before commit
-		os.Remove(editor.tmpFilename)
-		return nil
+		editor.aborted = true
+		editor.removeTmpFiles()
+		if editor.evicted {
+			return 0, ErrEntryEvicted
+		}
+		return 0, nil
 	}
 	if editor.isError {
-		//TODO: deal error
-		os.Remove(editor.tmpFilename)
-		os.Remove(editor.entry.GetCleanFilename())
-		return nil
+		editor.abort()
+		return 0, NewIllegalStateError("create output file failed, editor is aborted")
+	}
+	sizes := make([]int64, len(editor.tmpFilenames))
+	copy(sizes, editor.entry.sizes)
+	written := false
+	for i, name := range editor.tmpFilenames {
+		if name != "" {
+			written = true
+			sizes[i] = fileSize(name)
+		} else if !editor.entry.readable {
+			editor.abort()
+			return 0, NewIllegalStateError(fmt.Sprintf("new entry has no value at index %d, editor is aborted", i))
+		}
+	}
+	if !written {
+		editor.abort()
+		return 0, NewIllegalStateError("no output stream is created, editor is aborted")
+	}
+	size := int64(0)
+	for _, s := range sizes {
+		size += s
+	}
+	pinnedSize := editor.base.pinnedSize
+	if editor.entry.pins > 0 {
+		pinnedSize += size - editor.entry.size
+	}
+	if pinnedSize > editor.maxSize() {
+		// nothing can be evicted to make room
+		editor.abort()
+		return 0, NewPinnedSizeError(pinnedSize, editor.maxSize())
+	}
+	editor.base.recordUse(editor.entry.key)
+	if !editor.entry.readable && !editor.base.admit(editor.entry.key, size) {
+		return 0, editor.reject()
 	}
 
+	// open the old value before it is overwritten
+	replaced := editor.base.newEvictionEvent(editor.entry, EVICT_REPLACED)
+	for i, name := range editor.tmpFilenames {
+		if name == "" {
+			continue
+		}
+		if err := renameFile(name, editor.entry.GetCleanFilenameAt(i), true); err != nil {
+			// the old clean file may be removed by renameFile, so drop the entry
+			editor.aborted = true
+			editor.removeTmpFiles()
+			if replaced != nil {
+				replaced.Reason = EVICT_CORRUPT
+			}
+			editor.base.queueEviction(replaced)
+			editor.entry.readable = false
+			editor.base.removeEntry(editor.entry.key, EVICT_CORRUPT)
+			return 0, err
+		}
+	}
+	editor.base.queueEviction(replaced)
 	editor.entry.curEditor = nil
-	editor.base.curSize += (editor.FileSize() - editor.entry.size)
-	editor.entry.size = editor.FileSize()
+	editor.base.curSize -= editor.entry.size
+	editor.base.pinnedSize = pinnedSize
+	editor.entry.setSizes(sizes)
+	editor.commitSums()
+	editor.entry.meta = editor.meta
+	editor.entry.accessTime = editor.entry.time
+	editor.base.curSize += editor.entry.size
 	editor.commited = true
 	editor.entry.readable = true
+	if editor.entry.commitId == 0 {
+		editor.base.newEntries--
+	}
 	editor.entry.commitId = editor.base.sequential_id
 	editor.base.sequential_id++
+	editor.base.stats.commits.Add(1)
+	editor.base.policyInsert(editor.entry)
 
-	_, err := editor.base.journalFile.WriteString(
-		fmt.Sprintf("%s %s %d %d\n", CLEAN, editor.entry.key,
-			editor.entry.size, editor.entry.time.UnixMilli()),
-	)
-	if err != nil {
-		os.Remove(editor.tmpFilename)
-		return err
+	err := editor.base.syncCommited(editor)
+	err = firstError(editor.base.writeJournal(editor.entry.cleanLine()), err)
+	err = firstError(editor.base.flushJournal(), err)
+	seq, syncErr := editor.base.syncCommitRecord()
+	editor.base.checkFull()
+	return seq, firstError(err, syncErr)
+}
+
+// Abort gives up the edit, the tmp file is deleted and the previous clean value keeps readable
+func (editor *DiskLRUCacheEditor) Abort() error {
+	editor.base.lock.Lock()
+	defer editor.base.lock.Unlock()
+	defer editor.unlockStream()
+
+	if editor.commited || editor.aborted {
+		return NewIllegalStateError("editor is already commited or aborted")
 	}
-	renameFile(editor.tmpFilename, editor.entry.GetCleanFilename(), true)
+	return editor.abort()
+}
 
-	editor.base.checkFull()
-	return err
+// need lock manually
+func (editor *DiskLRUCacheEditor) abort() error {
+	editor.aborted = true
+	editor.base.stats.aborts.Add(1)
+	editor.removeTmpFiles()
+	entry := editor.entry
+	if entry.curEditor != editor {
+		// removed or evicted while editing
+		return nil
+	}
+	entry.curEditor = nil
+	if !entry.readable {
+		// nothing is commited, so no event
+		return editor.base.removeEntry(entry.key, EVICT_REMOVED)
+	}
+	// end the dirty record of journal
+	entry.time = editor.prevTime
+	return editor.base.writeJournal(entry.cleanLine())
+}
+
+func (editor *DiskLRUCacheEditor) removeTmpFiles() {
+	for _, name := range editor.tmpFilenames {
+		if name != "" {
+			os.Remove(name)
+		}
+	}
 }
 
 type DiskLRUCacheSnapshot struct {
 	Key    string
-	Size   int64
-	Reader Reader
+	Size   int64  // total size of all values
+	Reader Reader // reader of value 0
 	Time   time.Time
+	Expiry time.Time // zero if never expire
+
+	readers []Reader
+	sizes   []int64
+}
+
+func (snapshot *DiskLRUCacheSnapshot) GetReader(index int) Reader {
+	return snapshot.readers[index]
+}
+
+func (snapshot *DiskLRUCacheSnapshot) GetSize(index int) int64 {
+	return snapshot.sizes[index]
+}
+
+// close readers of all values
+func (snapshot *DiskLRUCacheSnapshot) Close() error {
+	var rst error
+	for _, reader := range snapshot.readers {
+		if err := reader.Close(); err != nil && rst == nil {
+			rst = err
+		}
+	}
+	return rst
+}
+
+// for windows,open a link to avoid file lock
+func openReader(name string) (Reader, error) {
+	if runtime.GOOS == "windows" {
+		tmpName := getAvailableLinkname(name)
+		err := os.Link(name, tmpName)
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.OpenFile(tmpName, os.O_RDONLY, 0666)
+		if err != nil {
+			os.Remove(tmpName)
+			return nil, err
+		}
+		return &AutoRemoveReader{File: file}, nil
+	}
+	return os.OpenFile(name, os.O_RDONLY, 0666)
 }
 
 func (cache *DiskLRUCache) Get(key string) (*DiskLRUCacheSnapshot, error) {
-	cache.lock.RLock()
-	defer cache.lock.RUnlock()
+	if _, err := cache.keyFilename(key); err != nil {
+		return nil, err
+	}
+	// reading changes the order of LRU, so it is a write
+	cache.lock.Lock()
+	defer cache.unlockAndNotify()
 	cache.checkNotClosed()
+	cache.recordUse(key)
 	entry := cache.entries.Get(key)
 	if entry == nil {
+		cache.stats.misses.Add(1)
+		return nil, nil
+	}
+	if entry.expired(cache.clock.Now()) {
+		cache.stats.misses.Add(1)
+		// the editor will commit a new value
+		if entry.curEditor == nil && !cache.readOnly {
+			cache.stats.expirations.Add(1)
+			cache.removeEntry(key, EVICT_EXPIRED)
+		}
 		return nil, nil
 	}
 	//wait data ready
@@ -278,197 +673,477 @@ func (cache *DiskLRUCache) Get(key string) (*DiskLRUCacheSnapshot, error) {
 	// 		return nil, nil
 	// 	}
 	// }
-	var reader Reader
-	// for windows,open a link to avoid file lock
-	if runtime.GOOS == "windows" {
-		tmpName := getAvailableLinkname(entry.GetCleanFilename())
-		err := os.Link(entry.GetCleanFilename(), tmpName)
-		if err != nil {
-			return nil, err
-		}
-		file, err := os.OpenFile(tmpName, os.O_RDONLY, 0666)
+	if !entry.readable {
+		cache.stats.misses.Add(1)
+		return nil, nil
+	}
+	readers := make([]Reader, 0, cache.valueCount)
+	for i := 0; i < cache.valueCount; i++ {
+		reader, err := openReader(entry.GetCleanFilenameAt(i))
 		if err != nil {
-			if err == os.ErrNotExist {
-				log.Printf("warning: cache %s exist,but file not exist", key)
+			for _, r := range readers {
+				r.Close()
 			}
-			return nil, err
-		}
-		reader = &AutoRemoveReader{File: file}
-
-	} else {
-		file, err := os.OpenFile(entry.GetCleanFilename(), os.O_RDONLY, 0666)
-		if err != nil {
-			if err == os.ErrNotExist {
-				log.Printf("warning: cache %s exist,but file not exist", key)
+			if os.IsNotExist(err) && !cache.readOnly {
+				cache.logger.Printf("warning: cache %s exist,but file not exist", key)
+				cache.removeEntry(key, EVICT_CORRUPT)
 			}
+			cache.stats.misses.Add(1)
 			return nil, err
 		}
-		reader = file
+		readers = append(readers, newStatsReader(cache.newVerifyingReader(entry, i, reader), &cache.stats))
 	}
 
-	cache.journalFile.WriteString(
-		fmt.Sprintf("%s %s\n", READ, key),
-	)
-	return &DiskLRUCacheSnapshot{key, entry.size, reader, entry.time}, nil
+	cache.stats.hits.Add(1)
+	entry.accessTime = cache.clock.Now()
+	if !cache.readOnly {
+		cache.policyAccess(key)
+		cache.writeJournal(cache.keyLine(READ, key))
+	}
+	return &DiskLRUCacheSnapshot{
+		Key:     key,
+		Size:    entry.size,
+		Reader:  readers[0],
+		Time:    entry.time,
+		Expiry:  entry.meta.expiry,
+		readers: readers,
+		sizes:   append([]int64(nil), entry.sizes...),
+	}, nil
 }
 
-func CreateDiskLRUCache(cachePath string, appVersion int, cacheVersion int, maxsize int64) *DiskLRUCache {
-
+// Open opens the cache stored in dir, the directory and journal are created if not exist.
+// Errors of reading the journal are returned as JournalFileFormatError or JournalVersionError.
+func Open(dir string, opts Options) (*DiskLRUCache, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
 	cache := &DiskLRUCache{
 		entries:       *NewLinkedHashList[CacheEntry](),
 		lock:          sync.RWMutex{},
-		appVersion:    appVersion,
-		cacheVersion:  cacheVersion,
+		appVersion:    opts.AppVersion,
+		cacheVersion:  opts.CacheVersion,
 		sequential_id: 1,
-		cachePath:     cachePath,
-		maxSize:       maxsize,
+		cachePath:     dir,
+		maxSize:       opts.MaxSize,
+		maxEntries:    opts.MaxEntries,
 		curSize:       0,
+		valueCount:    opts.ValueCount,
+		keyMapper:     opts.KeyMapper,
+		policy:        opts.EvictionPolicy,
+		shardLevels:   opts.ShardLevels,
 		journalFile:   nil,
+		fileMode:      opts.FileMode,
+		dirMode:       opts.dirMode(),
+		logger:        opts.Logger,
+		clock:         opts.Clock,
+
+		admission:          opts.Admission,
+		discardNotAdmitted: opts.DiscardNotAdmitted,
+
+		recoveryPolicy: opts.Recovery,
+		unknownFiles:   opts.UnknownFiles,
+
+		compactThreshold: opts.CompactThreshold,
+
+		journalBufferSize: opts.JournalBufferSize,
+		flushEachRecord:   opts.FlushInterval < 0,
+
+		journalFormat: opts.JournalFormat,
+		lockTimeout:   opts.LockTimeout,
+		readOnly:      opts.ReadOnly,
+		sharedLock:    opts.SharedLock,
+		durability:    opts.Durability,
+		checksum:      opts.Checksum,
+		syncDirSet:    make(map[string]struct{}),
+	}
+	if cache.readOnly {
+		// nothing is evicted or commited
+		cache.policy = nil
+		cache.admission = nil
 	}
+	cache.setPolicyMaxSize()
 	if err := cache.init(); err != nil {
+		cache.closeJournal()
+		unlockDir(cache.dirLock)
+		return nil, err
+	}
+	stop := make(chan struct{})
+	cache.stopBackground = stop
+	if cache.readOnly {
+		// the background tasks all write the journal
+		return cache, nil
+	}
+	if opts.SweepInterval > 0 {
+		cache.startSweeper(opts.SweepInterval, stop)
+	}
+	if cache.compactThreshold > 0 {
+		cache.startCompactor(stop)
+	}
+	if cache.durability == DURABILITY_PERIODIC {
+		cache.startSyncer(opts.SyncInterval, stop)
+	}
+	if opts.FlushInterval > 0 {
+		cache.startFlusher(opts.FlushInterval, stop)
+	}
+	return cache, nil
+}
+
+// Deprecated: use Open, which returns the error instead of panicking.
+func CreateDiskLRUCache(cachePath string, appVersion int, cacheVersion int, maxsize int64) *DiskLRUCache {
+	cache, err := Open(cachePath, Options{
+		AppVersion:   appVersion,
+		CacheVersion: cacheVersion,
+		MaxSize:      maxsize,
+	})
+	if err != nil {
 		log.Panicf("init lru cache failed,err:%s", err)
 	}
 	return cache
 }
+
 func (cache *DiskLRUCache) init() error {
+	if cache.readOnly {
+		return cache.initReadOnly()
+	}
 	if _, err := os.Stat(cache.cachePath); err != nil {
 		if !os.IsNotExist(err) {
 			return err
 		}
-		if err := os.MkdirAll(cache.cachePath, 0777); err != nil {
+		if err := os.MkdirAll(cache.cachePath, cache.dirMode); err != nil {
 			return err
 		}
 	}
-	// has journal file
-	if _, err := os.Stat(filepath.Join(cache.cachePath, JOURNAL_FILENAME)); err == nil {
-		file, err := os.OpenFile(filepath.Join(cache.cachePath, JOURNAL_FILENAME), os.O_CREATE|os.O_RDWR, 0666)
+	lock, err := lockDir(cache.cachePath, false, cache.lockTimeout, cache.fileMode)
+	if err != nil {
+		return err
+	}
+	cache.dirLock = lock
+	header, records, err := cache.loadJournal(JOURNAL_FILENAME)
+	if os.IsNotExist(err) {
+		//no journal file, create a new one
+		f, err := cache.newJournal(JOURNAL_FILENAME)
+		if err == nil {
+			cache.setJournal(f)
+			err = cache.syncNewJournal(f)
+		}
+		return err
+	}
+	if err != nil {
+		if !isJournalError(err) || cache.recoveryPolicy == RECOVERY_FAIL {
+			return err
+		}
+		return cache.recover(err, header, records)
+	}
+	need_rebuild, err := cache.applyHeader(header)
+	if err != nil {
+		return err
+	}
+	reconciled, err := cache.reconcile()
+	if err != nil {
+		return err
+	}
+	cache.loadPolicy(header.policy)
+	if need_rebuild || reconciled {
+		return cache.rebuildAndShrink()
+	}
+	return cache.openJournal()
+}
+
+// open the journal of a read-only cache, nothing in the directory is changed
+func (cache *DiskLRUCache) initReadOnly() error {
+	if cache.sharedLock {
+		lock, err := lockDir(cache.cachePath, true, cache.lockTimeout, cache.fileMode)
 		if err != nil {
 			return err
 		}
-		cache.journalFile = file
-		cache.parseFile(file)
-		return nil
+		cache.dirLock = lock
 	}
-	//no journal file, create a new one
-	f, err := cache.newJournal(JOURNAL_FILENAME)
-	if err == nil {
-		cache.journalFile = f
+	_, records, err := cache.loadJournal(JOURNAL_FILENAME)
+	if err != nil && isJournalError(err) && cache.recoveryPolicy == RECOVERY_TRUNCATE {
+		if _, versionMismatch := err.(*JournalVersionError); !versionMismatch {
+			lines := countJournalLines(filepath.Join(cache.cachePath, JOURNAL_FILENAME))
+			cache.recoveryReport = &RecoveryReport{Cause: err, Policy: RECOVERY_TRUNCATE, DroppedLines: lines - records}
+			cache.logRecover(cache.recoveryReport)
+			return nil
+		}
 	}
 	return err
 }
 
+// bring the loaded cache to the options which differ from the journal header
+func (cache *DiskLRUCache) applyHeader(header journalHeader) (need_rebuild bool, err error) {
+	if header.shardLevels != cache.shardLevels {
+		cache.logger.Printf("Warning: shard levels in journal file is %d, but current shard levels is %d,migrate\n",
+			header.shardLevels, cache.shardLevels)
+		if err := cache.migrateLayout(header.shardLevels); err != nil {
+			return false, err
+		}
+		need_rebuild = true
+	}
+	if header.keyMapper != cache.keyMapper.Name() {
+		cache.logger.Printf("Warning: files in journal file are named by %s, but current key mapper is %s,migrate\n",
+			header.keyMapper, cache.keyMapper.Name())
+		if err := cache.migrateKeys(); err != nil {
+			return false, err
+		}
+		need_rebuild = true
+	}
+	if header.format != cache.journalFormat {
+		cache.logger.Printf("Warning: journal format is %s, but current format is %s,convert\n", header.format, cache.journalFormat)
+		need_rebuild = true
+	}
+	if header.maxSize != cache.maxSize {
+		cache.logger.Printf("Warning: max size in journal file is %d, but current max size is %d,rebuild\n", header.maxSize, cache.maxSize)
+		need_rebuild = true
+	}
+	if header.maxEntries != cache.maxEntries {
+		cache.logger.Printf("Warning: max entries in journal file is %d, but current max entries is %d,rebuild\n",
+			header.maxEntries, cache.maxEntries)
+		need_rebuild = true
+	}
+	if header.policy != cache.policyName() {
+		cache.logger.Printf("Warning: eviction policy in journal file is %q, but current policy is %q,rebuild\n",
+			header.policy, cache.policyName())
+		need_rebuild = true
+	}
+	return need_rebuild, nil
+}
+
+func (cache *DiskLRUCache) rebuildAndShrink() error {
+	if err := cache.RebuildJournal(); err != nil {
+		return err
+	}
+	//if cache size become larger than max size, we need shrink the cache
+	cache.lock.Lock()
+	defer cache.unlockAndNotify()
+	cache.checkFull()
+	return nil
+}
+
+// replay the journal in cache dir, records before a bad line are kept even if an error is returned
+func (cache *DiskLRUCache) loadJournal(filename string) (header journalHeader, records int, err error) {
+	file, err := os.Open(filepath.Join(cache.cachePath, filename))
+	if err != nil {
+		return header, 0, err
+	}
+	defer file.Close()
+	header, records, err = cache.parseFile(file)
+	if size := journalGoodSize(err); size > 0 && cache.readOnly {
+		// a record being appended by the writer
+		cache.logger.Printf("warning: ignore journal %s after %d,cause:%s", filename, size, err)
+		err = nil
+	} else if size > 0 {
+		// a torn record at the end, the records before it are complete
+		cache.logger.Printf("warning: truncate journal %s at %d,cause:%s", filename, size, err)
+		cache.recoveryReport = &RecoveryReport{Cause: err, Policy: RECOVERY_TRUNCATE, DroppedLines: 1}
+		file.Close()
+		err = os.Truncate(filepath.Join(cache.cachePath, filename), size)
+	}
+	cache.journalRecords = int64(records)
+	cache.curSize = 0
+	iterator := cache.entries.Iterator()
+	for iterator.Next() {
+		cache.curSize += iterator.Value().size
+	}
+	return header, records, err
+}
+
+// open the journal file for appending records
+func (cache *DiskLRUCache) openJournal() error {
+	file, err := os.OpenFile(filepath.Join(cache.cachePath, JOURNAL_FILENAME), os.O_WRONLY|os.O_APPEND, cache.fileMode)
+	if err != nil {
+		return err
+	}
+	cache.setJournal(file)
+	return nil
+}
+
 // use to cretae new journal file
 func (cache *DiskLRUCache) newJournal(filename string) (*os.File, error) {
-	if _, err := os.Stat(path.Join(cache.cachePath, filename)); err != nil && os.IsExist(err) {
+	f, err := os.OpenFile(filepath.Join(cache.cachePath, filename), os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, cache.fileMode)
+	if err != nil {
 		return nil, err
 	}
-	f, err := os.OpenFile(filepath.Join(cache.cachePath, filename), os.O_CREATE|os.O_WRONLY, 0666)
+	//write meta data
+	_, err = f.WriteString(journalHead(cache.journalFormat, cache.header()))
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	//write meta data
-	f.WriteString(fmt.Sprintf("%s\n", FILE_HEAD))
-	f.WriteString(fmt.Sprintf("%d %d %d\n", cache.appVersion, cache.cacheVersion, cache.maxSize))
 	return f, nil
 
 }
+
+// rewrite the journal with one record per entry, the old one is kept as journal.bak
 func (cache *DiskLRUCache) RebuildJournal() error {
+	if cache.readOnly {
+		return ErrReadOnly
+	}
+	cache.rebuildLock.Lock()
+	defer cache.rebuildLock.Unlock()
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
+	// the old journal is kept as backup
+	if err := cache.flushJournal(); err != nil {
+		return err
+	}
 	file, err := cache.newJournal(JOURNAL_TMP_FILENAME)
 	if err != nil {
-		panic("Create or truncate journal file failed")
+		return err
 	}
+	lines := cache.journalLines()
+	if err := writeLines(file, lines); err != nil {
+		cache.dropTmpJournal(file)
+		return err
+	}
+	return cache.replaceJournal(file, len(lines))
+}
+
+// records describe the current entries in LRU order, need lock manually
+func (cache *DiskLRUCache) journalLines() []string {
+	lines := make([]string, 0, cache.entries.Len())
 	iterator := cache.entries.Iterator()
 	for iterator.Next() {
 		entry := iterator.Value()
+		if entry.readable {
+			// keep the commited value of an entry being edited
+			lines = append(lines, entry.cleanLine())
+		}
 		if entry.curEditor != nil || entry.readable == false {
-			file.WriteString(fmt.Sprintf("%s %s\n", DIRTY, entry.key))
-		} else {
-			file.WriteString(fmt.Sprintf("%s %s %d %d\n", CLEAN, entry.key, entry.size, entry.time.UnixMilli()))
+			lines = append(lines, cache.keyLine(DIRTY, entry.key))
+		}
+	}
+	return lines
+}
+
+func writeLines(file *os.File, lines []string) error {
+	for _, line := range lines {
+		if _, err := file.WriteString(line); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+func (cache *DiskLRUCache) dropTmpJournal(file *os.File) {
 	file.Close()
-	if cache.journalFile != nil {
-		cache.journalFile.Close()
-		cache.journalFile = nil
+	os.Remove(filepath.Join(cache.cachePath, JOURNAL_TMP_FILENAME))
+}
+
+// replace the journal by the written tmp journal, need lock manually
+func (cache *DiskLRUCache) replaceJournal(file *os.File, records int) error {
+	err := file.Close()
+	if cache.durability != DURABILITY_NONE && err == nil {
+		err = syncFileByName(file.Name())
 	}
-	// backup old journal file and rename to new
-	err = renameFile(filepath.Join(cache.cachePath, JOURNAL_FILENAME), filepath.Join(cache.cachePath, JOURNAL_BACKUP_FILE), true)
 	if err != nil {
-		log.Printf("warning: rename journal file failed,err:%s", err)
+		os.Remove(filepath.Join(cache.cachePath, JOURNAL_TMP_FILENAME))
+		return err
+	}
+	if err := cache.closeJournal(); err != nil {
+		cache.logger.Printf("warning: close journal file failed,err:%s", err)
+	}
+	// backup old journal file and rename to new
+	if _, err := os.Stat(filepath.Join(cache.cachePath, JOURNAL_FILENAME)); err == nil {
+		err = renameFile(filepath.Join(cache.cachePath, JOURNAL_FILENAME), filepath.Join(cache.cachePath, JOURNAL_BACKUP_FILE), true)
+		if err != nil {
+			cache.logger.Printf("warning: rename journal file failed,err:%s", err)
+		}
 	}
 	err = renameFile(filepath.Join(cache.cachePath, JOURNAL_TMP_FILENAME), filepath.Join(cache.cachePath, JOURNAL_FILENAME), true)
+	if err == nil && cache.durability != DURABILITY_NONE {
+		err = syncDir(cache.cachePath)
+	}
 	if err != nil {
-		log.Panicf("rename new journal file failed,err:%s", err)
+		// put the old journal back so the cache stays usable
+		renameFile(filepath.Join(cache.cachePath, JOURNAL_BACKUP_FILE), filepath.Join(cache.cachePath, JOURNAL_FILENAME), true)
+		if openErr := cache.openJournal(); openErr != nil {
+			cache.logger.Printf("warning: reopen journal file failed,err:%s", openErr)
+		}
+		return err
 	}
-	file, _ = os.OpenFile(filepath.Join(cache.cachePath, JOURNAL_FILENAME), os.O_RDWR, 0666)
-	cache.journalFile = file
-	return nil
+	cache.journalRecords = int64(records)
+	return cache.openJournal()
 }
 
-func (cache *DiskLRUCache) parseFile(file io.Reader) error {
-	need_rebuild := false
-	scanner := bufio.NewReader(file)
-	line, isPrefix, err := scanner.ReadLine()
-	if err != nil || isPrefix {
-		return NewJournalFileFormatError()
-	}
-	if string(line) != "go-disklrucache" {
-		return NewJournalFileFormatError()
+// apply the journal records to the cache, return the number of applied records.
+// a version mismatch is reported after all records are read, so the caller knows what is dropped
+func (cache *DiskLRUCache) parseFile(file io.Reader) (header journalHeader, records int, err error) {
+	header, reader, err := newJournalReader(file)
+	if err != nil {
+		return header, 0, err
 	}
-	line, isPrefix, _ = scanner.ReadLine()
-	strs := strings.Split(strings.TrimSpace(string(line)), " ")
-	if len(strs) != 3 {
-		return NewJournalFileFormatError()
+	if cache.readOnly {
+		// the files are where the journal says, nothing is migrated or rebuilt
+		cache.maxSize = header.maxSize
+		cache.maxEntries = header.maxEntries
+		cache.shardLevels = header.shardLevels
+		cache.journalFormat = header.format
+		if header.keyMapper == LEGACY_KEY_MAPPER {
+			cache.keyMapper = legacyKeyMapper{}
+		}
 	}
-	appVersion, err1 := strconv.Atoi(strs[0])
-	cacheVersion, err2 := strconv.Atoi(strs[1])
-	maxSize, err2 := strconv.ParseInt(strs[2], 10, 64)
-	if err1 != nil || err2 != nil {
-		return NewJournalFileFormatError()
+	// files of a legacy journal are renamed to the cache mapper by applyHeader
+	mapper := cache.keyMapper
+	if header.keyMapper == LEGACY_KEY_MAPPER {
+		mapper = legacyKeyMapper{}
 	}
-	if diff := appVersion - cache.appVersion + (cacheVersion - cache.cacheVersion); diff != 0 {
-		return NewJournalVersionError()
+	var versionErr error
+	if header.appVersion != cache.appVersion || header.cacheVersion != cache.cacheVersion {
+		versionErr = NewJournalVersionErrorWithMsg(fmt.Sprintf("journal version is %d %d, but expect %d %d",
+			header.appVersion, header.cacheVersion, cache.appVersion, cache.cacheVersion))
+	} else if header.keyMapper != mapper.Name() {
+		// files are named by the other mapper
+		return header, 0, NewJournalVersionErrorWithMsg(fmt.Sprintf("journal key mapper is %s, but expect %s",
+			header.keyMapper, cache.keyMapper.Name()))
+	} else if header.valueCount != cache.valueCount {
+		// records of other value count can not be read
+		return header, 0, NewJournalVersionErrorWithMsg(fmt.Sprintf("journal value count is %d, but expect %d",
+			header.valueCount, cache.valueCount))
 	}
-	if cache.maxSize != 0 && maxSize != cache.maxSize {
-		log.Printf("Warning: max size in journal file is %d, but current max size is %d,rebuild\n", maxSize, MAX_FILE_SIZE)
-		need_rebuild = true
-	}
-	cache.cacheVersion = cacheVersion
-	cache.appVersion = appVersion
 	dirtyMap := make(map[string]*DoublyLinkedListNode[CacheEntry])
 	for {
-		line, isPrefix, err = scanner.ReadLine()
+		record, err := reader.next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return header, records, firstError(versionErr, err)
 		}
-		if isPrefix {
-			return NewJournalFileFormatError()
+		key := record.key
+		operator := record.operator
+		var filename string
+		if operator == DIRTY || operator == CLEAN {
+			if filename, err = mapKeyFilename(mapper, key); err != nil {
+				return header, records, firstError(versionErr, reader.recordError(""))
+			}
 		}
-		strs = strings.Split(strings.TrimSpace(string(line)), " ")
-		operator := strs[0]
 		if operator == DIRTY {
-			dirty_node := cache.entries.Set(strs[1], CacheEntry{
-				base:      cache,
-				key:       strs[1],
-				size:      0,
-				readable:  false,
-				commitId:  0,
-				curEditor: nil,
-			})
-			dirtyMap[strs[1]] = dirty_node
+			// like Edit, a dirty record moves the entry to the tail but keeps its clean value
+			if cache.entries.Get(key) == nil {
+				cache.entries.Set(key, CacheEntry{
+					base:      cache,
+					key:       key,
+					filename:  filename,
+					dir:       shardDir(key, cache.shardLevels),
+					size:      0,
+					readable:  false,
+					commitId:  0,
+					curEditor: nil,
+				})
+			}
+			dirtyMap[key] = cache.entries.data_map[key]
 		} else if operator == CLEAN {
-			node, ok := dirtyMap[strs[1]]
+			node, ok := dirtyMap[key]
 			var entry *CacheEntry
 			if !ok {
 				//the rebuiild journal will not have dirty entry
-				node := cache.entries.Set(strs[1], CacheEntry{
+				node := cache.entries.Set(key, CacheEntry{
 					base:      cache,
-					key:       strs[1],
+					key:       key,
+					filename:  filename,
+					dir:       shardDir(key, cache.shardLevels),
 					size:      0,
 					readable:  true,
 					commitId:  0,
@@ -479,42 +1154,52 @@ func (cache *DiskLRUCache) parseFile(file io.Reader) error {
 				//change dirty entry to clean entry won't change the order of LRU
 				//so we will get these nodes from dirtyMap
 				entry = &node.val
+				delete(dirtyMap, key)
 			}
 			entry.commitId = cache.sequential_id
 			cache.sequential_id += 1
-			entry.size, _ = strconv.ParseInt(strs[2], 10, 64)
+			entry.setSizes(record.sizes)
 			entry.readable = true
-			timeStamp, _ := strconv.ParseInt(strs[3], 10, 64)
-			entry.time = time.UnixMilli(timeStamp)
+			entry.time = record.time
+			entry.accessTime = entry.time
+			entry.meta = record.meta
+			entry.policyState = record.meta.policy
+			entry.meta.policy = ""
+			entry.replayReads = 0
 		} else if operator == READ {
-			cache.entries.Get(strs[1])
-		} else if operator == DEL {
-			entry := cache.entries.Get(strs[1])
-			if entry != nil {
-				cache.entries.Del(strs[1])
+			if entry := cache.entries.Get(key); entry != nil {
+				entry.replayReads++
 			}
-		} else {
-			log.Panicf("unknown journal operator:%s", operator)
+		} else if operator == DEL {
+			cache.entries.Del(key)
+			delete(dirtyMap, key)
 		}
+		records++
 	}
-	if need_rebuild {
-		if err := cache.RebuildJournal(); err != nil {
-			return err
-		}
-		//if cache size become larger than max size, we need shrink the cache
-		cache.lock.Lock()
-		defer cache.lock.Unlock()
-		cache.checkFull()
+	return header, records, versionErr
+}
+
+// wait the background goroutines exit, it is safe to call more than once
+func (cache *DiskLRUCache) stopBackgroundTasks() {
+	cache.lock.Lock()
+	stop := cache.stopBackground
+	cache.stopBackground = nil
+	cache.lock.Unlock()
+	if stop != nil {
+		close(stop)
+		cache.background.Wait()
 	}
-	return nil
 }
 
 func (cache *DiskLRUCache) Close() error {
+	cache.stopBackgroundTasks()
+	err := cache.syncAll()
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
-	if cache.journalFile != nil {
-		cache.journalFile.Close()
-	}
-	cache.journalFile = nil
-	return nil
+	err = firstError(cache.closeJournal(), err)
+	// the lock is released after the journal is complete
+	err = firstError(err, unlockDir(cache.dirLock))
+	cache.dirLock = nil
+	cache.closed = true
+	return err
 }
@@ -0,0 +1,234 @@
+package disklrucache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+type Durability int
+
+const (
+	// leave the writeback to the OS, a crash may lose commits or keep records of truncated files
+	DURABILITY_NONE Durability = iota
+	// sync the value files, their directories and the journal before Commit returns
+	DURABILITY_COMMIT
+	// sync every Options.SyncInterval in background,
+	// the commits of the last interval may be lost or point to truncated files after a crash
+	DURABILITY_PERIODIC
+	// like DURABILITY_COMMIT, but the directories and journal are synced out of the cache lock,
+	// so concurrent commits share one sync
+	DURABILITY_GROUP
+)
+
+const (
+	DEFAULT_SYNC_INTERVAL = time.Second
+)
+
+func (durability Durability) String() string {
+	switch durability {
+	case DURABILITY_NONE:
+		return "none"
+	case DURABILITY_COMMIT:
+		return "commit"
+	case DURABILITY_PERIODIC:
+		return "periodic"
+	case DURABILITY_GROUP:
+		return "group"
+	}
+	return "unknown"
+}
+
+// the crash tests replace them to record what reaches the disk
+var (
+	syncFile = func(file *os.File) error {
+		return file.Sync()
+	}
+	syncDir = func(dir string) error {
+		// directories can not be synced on windows, renames are durable there
+		if runtime.GOOS == "windows" {
+			return nil
+		}
+		file, err := os.Open(dir)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return syncFile(file)
+	}
+)
+
+// sync a file written by an editor, a file removed by eviction is ignored
+func syncFileByName(name string) error {
+	file, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return syncFile(file)
+}
+
+// the cache directory and the shard directories of entry
+func (entry *CacheEntry) syncDirs() []string {
+	dirs := []string{entry.base.cachePath}
+	if entry.dir == "" {
+		return dirs
+	}
+	dir := entry.base.cachePath
+	for _, name := range strings.Split(filepath.ToSlash(entry.dir), "/") {
+		dir = filepath.Join(dir, name)
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// sync the written values before the cache lock is taken by Commit
+func (editor *DiskLRUCacheEditor) syncTmpFiles() error {
+	durability := editor.base.durability
+	if durability != DURABILITY_COMMIT && durability != DURABILITY_GROUP {
+		return nil
+	}
+	for _, name := range editor.tmpFilenames {
+		if name == "" {
+			continue
+		}
+		if err := syncFileByName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// make the renamed values of commit durable before the clean record is written, need lock manually
+func (cache *DiskLRUCache) syncCommited(editor *DiskLRUCacheEditor) error {
+	switch cache.durability {
+	case DURABILITY_COMMIT:
+		for _, dir := range editor.entry.syncDirs() {
+			if err := syncDir(dir); err != nil {
+				return err
+			}
+		}
+	case DURABILITY_PERIODIC:
+		for i, name := range editor.tmpFilenames {
+			if name != "" {
+				cache.syncFiles = append(cache.syncFiles, editor.entry.GetCleanFilenameAt(i))
+			}
+		}
+		fallthrough
+	case DURABILITY_GROUP:
+		for _, dir := range editor.entry.syncDirs() {
+			cache.syncDirSet[dir] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// sync the journal after the clean record of commit is written, need lock manually.
+// return the record to wait for by syncUpTo in group mode, 0 if nothing to wait
+func (cache *DiskLRUCache) syncCommitRecord() (uint64, error) {
+	switch cache.durability {
+	case DURABILITY_COMMIT:
+		// the record is flushed by commit
+		return 0, syncFile(cache.journalFile)
+	case DURABILITY_GROUP:
+		return cache.journalSeq, nil
+	}
+	return 0, nil
+}
+
+// sync everything written to the journal so far
+func (cache *DiskLRUCache) syncAll() error {
+	if cache.durability == DURABILITY_NONE {
+		return nil
+	}
+	cache.lock.RLock()
+	seq := cache.journalSeq
+	cache.lock.RUnlock()
+	return cache.syncUpTo(seq)
+}
+
+// sync the pending files, directories and the journal until record seq is durable.
+// the first caller syncs for all records written so far, the others waiting on syncLock find their record synced
+func (cache *DiskLRUCache) syncUpTo(seq uint64) error {
+	cache.syncLock.Lock()
+	defer cache.syncLock.Unlock()
+	if cache.syncedSeq >= seq {
+		return nil
+	}
+	cache.lock.Lock()
+	if err := cache.flushJournal(); err != nil {
+		cache.lock.Unlock()
+		return err
+	}
+	files := cache.syncFiles
+	dirs := cache.syncDirSet
+	cache.syncFiles = nil
+	cache.syncDirSet = make(map[string]struct{})
+	target := cache.journalSeq
+	journal := cache.journalFile
+	cache.lock.Unlock()
+
+	var err error
+	for _, name := range files {
+		err = firstError(err, syncFileByName(name))
+	}
+	for dir := range dirs {
+		if dirErr := syncDir(dir); !os.IsNotExist(dirErr) {
+			err = firstError(err, dirErr)
+		}
+	}
+	if journal != nil {
+		// a journal closed by compaction is synced before it is replaced
+		if syncErr := syncFile(journal); !errors.Is(syncErr, os.ErrClosed) {
+			err = firstError(err, syncErr)
+		}
+	}
+	if err != nil {
+		// try them again next time
+		cache.lock.Lock()
+		cache.syncFiles = append(cache.syncFiles, files...)
+		for dir := range dirs {
+			cache.syncDirSet[dir] = struct{}{}
+		}
+		cache.lock.Unlock()
+		return err
+	}
+	cache.syncedSeq = target
+	return nil
+}
+
+func (cache *DiskLRUCache) startSyncer(interval time.Duration, stop chan struct{}) {
+	cache.background.Add(1)
+	go func() {
+		defer cache.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := cache.syncAll(); err != nil {
+					cache.logger.Printf("warning: sync cache failed,err:%s", err)
+				}
+			}
+		}
+	}()
+}
+
+// sync a journal created by Open, need lock manually
+func (cache *DiskLRUCache) syncNewJournal(file *os.File) error {
+	if cache.durability == DURABILITY_NONE {
+		return nil
+	}
+	if err := syncFile(file); err != nil {
+		return err
+	}
+	return syncDir(cache.cachePath)
+}
@@ -1,7 +1,25 @@
 package disklrucache
 
+import (
+	"errors"
+	"fmt"
+)
+
+// returned by TryEdit when the entry has an unfinished editor
+var ErrEntryEditing = errors.New("entry is being edited")
+
+// returned by the methods changing a cache opened by Options.ReadOnly
+var ErrReadOnly = errors.New("cache is opened read-only")
+
+// returned by Commit when Options.Admission keeps the new entry out of the full cache
+var ErrNotAdmitted = errors.New("entry is not admitted to the cache")
+
+// returned by Commit when the entry is evicted by the size or entries limit while being edited
+var ErrEntryEvicted = errors.New("entry is evicted while being edited")
+
 type JournalFileFormatError struct {
-	msg string
+	msg      string
+	goodSize int64 // bytes before a torn record at the end of journal
 }
 
 func (e *JournalFileFormatError) Error() string {
@@ -24,6 +42,9 @@ func (e *JournalVersionError) Error() string {
 func NewJournalVersionError() *JournalVersionError {
 	return &JournalVersionError{msg: "journal version error"}
 }
+func NewJournalVersionErrorWithMsg(msg string) *JournalVersionError {
+	return &JournalVersionError{msg: msg}
+}
 
 type IllegalStateError struct {
 	msg string
@@ -32,3 +53,57 @@ type IllegalStateError struct {
 func (e *IllegalStateError) Error() string {
 	return e.msg
 }
+func NewIllegalStateError(msg string) *IllegalStateError {
+	return &IllegalStateError{msg: msg}
+}
+
+type IllegalArgumentError struct {
+	msg string
+}
+
+func (e *IllegalArgumentError) Error() string {
+	return e.msg
+}
+func NewIllegalArgumentError(msg string) *IllegalArgumentError {
+	return &IllegalArgumentError{msg: msg}
+}
+
+type InvalidKeyError struct {
+	Key string
+	msg string
+}
+
+func (e *InvalidKeyError) Error() string {
+	return fmt.Sprintf("invalid key %q: %s", e.Key, e.msg)
+}
+func NewInvalidKeyError(key string, msg string) *InvalidKeyError {
+	return &InvalidKeyError{Key: key, msg: msg}
+}
+
+// returned by the reader of a snapshot when the value read does not match its checksum,
+// the entry is removed from the cache
+type CorruptEntryError struct {
+	Key      string
+	Index    int
+	Checksum ChecksumType
+}
+
+func (e *CorruptEntryError) Error() string {
+	return fmt.Sprintf("cache %q value %d does not match its %s checksum", e.Key, e.Index, e.Checksum)
+}
+func NewCorruptEntryError(key string, index int, checksum ChecksumType) *CorruptEntryError {
+	return &CorruptEntryError{Key: key, Index: index, Checksum: checksum}
+}
+
+// returned by Commit when the pinned entries alone would be larger than the max size
+type PinnedSizeError struct {
+	PinnedSize int64
+	MaxSize    int64
+}
+
+func (e *PinnedSizeError) Error() string {
+	return fmt.Sprintf("pinned entries take %d bytes, more than the max size %d, unpin some entries", e.PinnedSize, e.MaxSize)
+}
+func NewPinnedSizeError(pinnedSize int64, maxSize int64) *PinnedSizeError {
+	return &PinnedSizeError{PinnedSize: pinnedSize, MaxSize: maxSize}
+}
@@ -0,0 +1,130 @@
+package disklrucache
+
+import (
+	"time"
+)
+
+type EvictReason int
+
+const (
+	// removed because the cache is full
+	EVICT_CAPACITY EvictReason = iota
+	// removed because the expiry is reached
+	EVICT_EXPIRED
+	// removed by Remove
+	EVICT_REMOVED
+	// the value is overwritten by a commit
+	EVICT_REPLACED
+	// the files of the entry are missing or broken
+	EVICT_CORRUPT
+)
+
+func (reason EvictReason) String() string {
+	switch reason {
+	case EVICT_CAPACITY:
+		return "capacity"
+	case EVICT_EXPIRED:
+		return "expired"
+	case EVICT_REMOVED:
+		return "removed"
+	case EVICT_REPLACED:
+		return "replaced"
+	case EVICT_CORRUPT:
+		return "corrupt"
+	}
+	return "unknown"
+}
+
+// EvictionEvent describes a commited value which leaves the cache
+type EvictionEvent struct {
+	Key  string
+	Size int64
+	// time since the value was written
+	Age time.Duration
+	// last time the value is read by Get, the commit time if never read
+	LastAccess time.Time
+	Reason     EvictReason
+
+	readers []Reader
+	sizes   []int64
+}
+
+// reader of the evicted value at index, nil if the file can not be opened.
+// The value files are already deleted, the reader is only valid until the listener returns
+func (event *EvictionEvent) GetReader(index int) Reader {
+	return event.readers[index]
+}
+
+func (event *EvictionEvent) GetSize(index int) int64 {
+	return event.sizes[index]
+}
+
+func (event *EvictionEvent) close() {
+	for _, reader := range event.readers {
+		if reader != nil {
+			reader.Close()
+		}
+	}
+}
+
+// OnEvict adds a listener called for every commited value removed from the cache.
+// Listeners are called after the cache lock is released, so they can use the cache.
+func (cache *DiskLRUCache) OnEvict(listener func(EvictionEvent)) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.evictListeners = append(cache.evictListeners, listener)
+}
+
+// create the event of a readable entry before its files are deleted, nil if nobody listens.
+// need lock manually
+func (cache *DiskLRUCache) newEvictionEvent(entry *CacheEntry, reason EvictReason) *EvictionEvent {
+	if len(cache.evictListeners) == 0 || !entry.readable {
+		return nil
+	}
+	commitTime := entry.time
+	if entry.curEditor != nil {
+		commitTime = entry.curEditor.prevTime
+	}
+	event := &EvictionEvent{
+		Key:        entry.key,
+		Size:       entry.size,
+		Age:        cache.clock.Now().Sub(commitTime),
+		LastAccess: entry.accessTime,
+		Reason:     reason,
+		readers:    make([]Reader, cache.valueCount),
+		sizes:      append([]int64(nil), entry.sizes...),
+	}
+	// an opened file keeps readable after it is deleted, openReader links it on windows
+	for i := range event.readers {
+		if reader, err := openReader(entry.GetCleanFilenameAt(i)); err == nil {
+			event.readers[i] = reader
+		}
+	}
+	return event
+}
+
+// need lock manually
+func (cache *DiskLRUCache) queueEviction(event *EvictionEvent) {
+	if event != nil {
+		cache.pendingEvictions = append(cache.pendingEvictions, event)
+	}
+}
+
+// need lock manually
+func (cache *DiskLRUCache) evict(entry *CacheEntry, reason EvictReason) {
+	cache.queueEviction(cache.newEvictionEvent(entry, reason))
+}
+
+// release the cache lock and call the listeners with the evictions queued under it
+func (cache *DiskLRUCache) unlockAndNotify() {
+	events := cache.pendingEvictions
+	cache.pendingEvictions = nil
+	listeners := cache.evictListeners
+	cache.lock.Unlock()
+	for _, event := range events {
+		for _, listener := range listeners {
+			listener(*event)
+		}
+		event.close()
+	}
+}
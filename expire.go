@@ -0,0 +1,45 @@
+package disklrucache
+
+import (
+	"time"
+)
+
+// remove all expired entries which are not being edited, return the number of removed entries
+func (cache *DiskLRUCache) RemoveExpired() int {
+	cache.lock.Lock()
+	defer cache.unlockAndNotify()
+	if cache.journalFile == nil {
+		return 0
+	}
+	now := cache.clock.Now()
+	expired := make([]string, 0)
+	iterator := cache.entries.Iterator()
+	for iterator.Next() {
+		entry := iterator.Value()
+		if entry.readable && entry.curEditor == nil && entry.expired(now) {
+			expired = append(expired, entry.key)
+		}
+	}
+	for _, key := range expired {
+		cache.stats.expirations.Add(1)
+		cache.removeEntry(key, EVICT_EXPIRED)
+	}
+	return len(expired)
+}
+
+func (cache *DiskLRUCache) startSweeper(interval time.Duration, stop chan struct{}) {
+	cache.background.Add(1)
+	go func() {
+		defer cache.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				cache.RemoveExpired()
+			}
+		}
+	}()
+}
@@ -0,0 +1,191 @@
+package disklrucache
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// cost of an entry commited without DiskLRUCacheEditor.SetCost
+	DEFAULT_COST = 1.0
+)
+
+// CostPolicy is an EvictionPolicy which weighs entries by the cost given to DiskLRUCacheEditor.SetCost,
+// the cache calls OnInsertCost and RestoreEntryCost instead of OnInsert and RestoreEntry
+type CostPolicy interface {
+	EvictionPolicy
+	OnInsertCost(key string, size int64, cost float64)
+	RestoreEntryCost(key string, size int64, cost float64, state string)
+}
+
+type gdsItem struct {
+	key      string
+	size     int64
+	cost     float64
+	priority float64
+	seq      uint64 // the least recently used of the same priority is evicted first
+	index    int
+}
+
+type gdsHeap []*gdsItem
+
+func (h gdsHeap) Len() int {
+	return len(h)
+}
+
+func (h gdsHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h gdsHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *gdsHeap) Push(x any) {
+	item := x.(*gdsItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *gdsHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// GreedyDualSizePolicy evicts the entry of the lowest priority, which is cost/size plus an inflation
+// raised to the priority of every evicted entry, so expensive small entries outlive cheap large ones
+// and entries not used for long lose to the new ones
+type GreedyDualSizePolicy struct {
+	items     map[string]*gdsItem
+	heap      gdsHeap
+	inflation float64 // L of the paper
+	seq       uint64
+	victim    string // returned by the last Victim
+}
+
+func NewGreedyDualSizePolicy() *GreedyDualSizePolicy {
+	return &GreedyDualSizePolicy{items: make(map[string]*gdsItem)}
+}
+
+func (policy *GreedyDualSizePolicy) Name() string {
+	return "gds"
+}
+
+func (policy *GreedyDualSizePolicy) OnInsert(key string, size int64) {
+	policy.OnInsertCost(key, size, DEFAULT_COST)
+}
+
+func (policy *GreedyDualSizePolicy) OnInsertCost(key string, size int64, cost float64) {
+	item := policy.set(key, size, cost)
+	policy.update(item, item.basePriority(policy.inflation))
+}
+
+func (policy *GreedyDualSizePolicy) OnAccess(key string) {
+	if item := policy.items[key]; item != nil {
+		policy.update(item, item.basePriority(policy.inflation))
+	}
+}
+
+// get the item of key with the new size and cost, it is not in the heap if new
+func (policy *GreedyDualSizePolicy) set(key string, size int64, cost float64) *gdsItem {
+	item := policy.items[key]
+	if item == nil {
+		item = &gdsItem{key: key, index: -1}
+		policy.items[key] = item
+	}
+	item.size, item.cost = size, cost
+	return item
+}
+
+func (item *gdsItem) basePriority(inflation float64) float64 {
+	return inflation + item.cost/float64(max(item.size, 1))
+}
+
+// give item a new priority as the most recently used, it is pushed if not in the heap
+func (policy *GreedyDualSizePolicy) update(item *gdsItem, priority float64) {
+	if item.key == policy.victim {
+		// used again, no longer the victim
+		policy.victim = ""
+	}
+	item.priority = priority
+	policy.seq++
+	item.seq = policy.seq
+	if item.index < 0 {
+		heap.Push(&policy.heap, item)
+	} else {
+		heap.Fix(&policy.heap, item.index)
+	}
+}
+
+// removing the victim raises the inflation to its priority, like an eviction
+func (policy *GreedyDualSizePolicy) OnRemove(key string) {
+	item := policy.items[key]
+	if item == nil {
+		return
+	}
+	if key == policy.victim {
+		policy.inflation = max(policy.inflation, item.priority)
+		policy.victim = ""
+	}
+	heap.Remove(&policy.heap, item.index)
+	delete(policy.items, key)
+}
+
+// the lowest priority not skipped, the whole heap is searched if the root is skipped
+func (policy *GreedyDualSizePolicy) Victim(skip func(key string) bool) (string, bool) {
+	var victim *gdsItem
+	for i, item := range policy.heap {
+		if skip != nil && skip(item.key) {
+			continue
+		}
+		if victim == nil || policy.heap.Less(i, victim.index) {
+			victim = item
+		}
+		if i == 0 {
+			break
+		}
+	}
+	if victim == nil {
+		return "", false
+	}
+	policy.victim = victim.key
+	return victim.key, true
+}
+
+// "priority:inflation"
+func (policy *GreedyDualSizePolicy) EntryState(key string) string {
+	item := policy.items[key]
+	if item == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s", strconv.FormatFloat(item.priority, 'g', -1, 64),
+		strconv.FormatFloat(policy.inflation, 'g', -1, 64))
+}
+
+func (policy *GreedyDualSizePolicy) RestoreEntry(key string, size int64, state string) {
+	policy.RestoreEntryCost(key, size, DEFAULT_COST, state)
+}
+
+// the most recently used entry is restored last, so its record has the latest inflation
+func (policy *GreedyDualSizePolicy) RestoreEntryCost(key string, size int64, cost float64, state string) {
+	item := policy.set(key, size, cost)
+	priorityStr, inflationStr, _ := strings.Cut(state, ":")
+	priority, err1 := strconv.ParseFloat(priorityStr, 64)
+	inflation, err2 := strconv.ParseFloat(inflationStr, 64)
+	if err1 != nil || err2 != nil {
+		priority = item.basePriority(policy.inflation)
+	} else {
+		policy.inflation = inflation
+	}
+	policy.update(item, priority)
+}
@@ -0,0 +1,137 @@
+package disklrucache
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// EntryInfo describes an entry without opening its files
+type EntryInfo struct {
+	Key   string
+	Size  int64
+	Sizes []int64
+	// time of the last commit
+	Time       time.Time
+	AccessTime time.Time
+	Expiry     time.Time // zero if never expire
+	Cost       float64   // given by SetCost, DEFAULT_COST if not set
+	// false if the entry is never commited
+	Readable bool
+	Editing  bool
+	// pins taken by Pin
+	Pins int
+}
+
+// get the entries from the least recently used to the most, it does not change the LRU order
+func (cache *DiskLRUCache) Entries() []EntryInfo {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	infos := make([]EntryInfo, 0, cache.entries.Len())
+	iterator := cache.entries.Iterator()
+	for iterator.Next() {
+		entry := iterator.Value()
+		infos = append(infos, EntryInfo{
+			Key:        entry.key,
+			Size:       entry.size,
+			Sizes:      append([]int64(nil), entry.sizes...),
+			Time:       entry.time,
+			AccessTime: entry.accessTime,
+			Expiry:     entry.meta.expiry,
+			Cost:       entry.meta.entryCost(),
+			Readable:   entry.readable,
+			Editing:    entry.curEditor != nil,
+			Pins:       entry.pins,
+		})
+	}
+	return infos
+}
+
+// JournalHeader is the header of a journal read by JournalScanner
+type JournalHeader struct {
+	Format       JournalFormat
+	AppVersion   int
+	CacheVersion int
+	MaxSize      int64
+	MaxEntries   int
+	ValueCount   int
+	// name of the KeyMapper
+	KeyMapper   string
+	ShardLevels int
+	// name of the eviction policy, "" for the default LRU order
+	Policy string
+}
+
+// JournalRecord is a record read by JournalScanner
+type JournalRecord struct {
+	// DIRTY, CLEAN, DEL or READ
+	Operator string
+	Key      string
+	// the rest are only set for CLEAN
+	Sizes    []int64
+	Time     time.Time
+	Expiry   time.Time
+	Checksum ChecksumType
+	Sums     [][]byte
+	Cost     float64 // 0 if not set
+	// EntryState of the eviction policy
+	PolicyState string
+}
+
+// JournalScanner reads the records of a journal one by one for tools, the cache does not need to be opened
+type JournalScanner struct {
+	file   *os.File
+	header JournalHeader
+	reader journalReader
+}
+
+// open the journal in dir of either format
+func OpenJournal(dir string) (*JournalScanner, error) {
+	file, err := os.Open(filepath.Join(dir, JOURNAL_FILENAME))
+	if err != nil {
+		return nil, err
+	}
+	header, reader, err := newJournalReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &JournalScanner{file: file, reader: reader, header: JournalHeader{
+		Format:       header.format,
+		AppVersion:   header.appVersion,
+		CacheVersion: header.cacheVersion,
+		MaxSize:      header.maxSize,
+		MaxEntries:   header.maxEntries,
+		ValueCount:   header.valueCount,
+		KeyMapper:    header.keyMapper,
+		ShardLevels:  header.shardLevels,
+		Policy:       header.policy,
+	}}, nil
+}
+
+func (scanner *JournalScanner) Header() JournalHeader {
+	return scanner.header
+}
+
+// return io.EOF after the last record, or a JournalFileFormatError at a bad record
+func (scanner *JournalScanner) Next() (JournalRecord, error) {
+	record, err := scanner.reader.next()
+	if err != nil {
+		return JournalRecord{}, err
+	}
+	rst := JournalRecord{Operator: record.operator, Key: record.key}
+	if record.operator == CLEAN {
+		rst.Sizes = record.sizes
+		rst.Time = record.time
+		rst.Expiry = record.meta.expiry
+		rst.Checksum = record.meta.checksum
+		rst.Sums = record.meta.sums
+		rst.Cost = record.meta.cost
+		rst.PolicyState = record.meta.policy
+	}
+	return rst, nil
+}
+
+func (scanner *JournalScanner) Close() error {
+	return scanner.file.Close()
+}
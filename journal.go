@@ -0,0 +1,188 @@
+package disklrucache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the second line of journal: "appVersion cacheVersion maxSize [name=value...]",
+// attributes are only written when they are not default so old journals keep parsable.
+// keys is always written, a journal without it names files by the raw keys, see LEGACY_KEY_MAPPER
+type journalHeader struct {
+	appVersion   int
+	cacheVersion int
+	maxSize      int64
+	maxEntries   int
+	valueCount   int
+	keyMapper    string
+	shardLevels  int
+	policy       string        // name of the eviction policy, "" if none
+	format       JournalFormat // not written, known by the head of journal
+}
+
+const (
+	HEADER_VALUE_COUNT = "values"
+	HEADER_KEY_MAPPER  = "keys"
+	HEADER_SHARDS      = "shards"
+	HEADER_POLICY      = "policy"
+	HEADER_MAX_ENTRIES = "entries"
+)
+
+func (cache *DiskLRUCache) header() journalHeader {
+	return journalHeader{
+		appVersion:   cache.appVersion,
+		cacheVersion: cache.cacheVersion,
+		maxSize:      cache.maxSize,
+		maxEntries:   cache.maxEntries,
+		valueCount:   cache.valueCount,
+		keyMapper:    cache.keyMapper.Name(),
+		shardLevels:  cache.shardLevels,
+		policy:       cache.policyName(),
+	}
+}
+
+func (header journalHeader) String() string {
+	line := fmt.Sprintf("%d %d %d", header.appVersion, header.cacheVersion, header.maxSize)
+	if header.valueCount != 1 {
+		line += fmt.Sprintf(" %s=%d", HEADER_VALUE_COUNT, header.valueCount)
+	}
+	if header.keyMapper != LEGACY_KEY_MAPPER {
+		line += fmt.Sprintf(" %s=%s", HEADER_KEY_MAPPER, escapeJournalKey(header.keyMapper))
+	}
+	if header.shardLevels != 0 {
+		line += fmt.Sprintf(" %s=%d", HEADER_SHARDS, header.shardLevels)
+	}
+	if header.policy != "" {
+		line += fmt.Sprintf(" %s=%s", HEADER_POLICY, escapeJournalKey(header.policy))
+	}
+	if header.maxEntries != 0 {
+		line += fmt.Sprintf(" %s=%d", HEADER_MAX_ENTRIES, header.maxEntries)
+	}
+	return line
+}
+
+func parseJournalHeader(line string) (journalHeader, error) {
+	header := journalHeader{valueCount: 1, keyMapper: LEGACY_KEY_MAPPER}
+	strs := strings.Split(strings.TrimSpace(line), " ")
+	if len(strs) < 3 {
+		return header, NewJournalFileFormatError()
+	}
+	var err1, err2, err3 error
+	header.appVersion, err1 = strconv.Atoi(strs[0])
+	header.cacheVersion, err2 = strconv.Atoi(strs[1])
+	header.maxSize, err3 = strconv.ParseInt(strs[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return header, NewJournalFileFormatError()
+	}
+	for _, attr := range strs[3:] {
+		name, value, ok := strings.Cut(attr, "=")
+		if !ok {
+			return header, NewJournalFileFormatError()
+		}
+		var err error
+		switch name {
+		case HEADER_VALUE_COUNT:
+			header.valueCount, err = strconv.Atoi(value)
+			if err == nil && header.valueCount < 1 {
+				err = NewJournalFileFormatError()
+			}
+		case HEADER_SHARDS:
+			header.shardLevels, err = strconv.Atoi(value)
+			if err == nil && (header.shardLevels < 0 || header.shardLevels > MAX_SHARD_LEVELS) {
+				err = NewJournalFileFormatError()
+			}
+		case HEADER_KEY_MAPPER:
+			header.keyMapper, err = unescapeJournalKey(value)
+		case HEADER_MAX_ENTRIES:
+			header.maxEntries, err = strconv.Atoi(value)
+			if err == nil && header.maxEntries < 0 {
+				err = NewJournalFileFormatError()
+			}
+		case HEADER_POLICY:
+			header.policy, err = unescapeJournalKey(value)
+		default:
+			// attributes of newer versions are ignored
+		}
+		if err != nil {
+			return header, NewJournalFileFormatError()
+		}
+	}
+	return header, nil
+}
+
+const (
+	ATTR_EXPIRE = "expire"
+	ATTR_SUM    = "sum"
+	ATTR_POLICY = "policy"
+	ATTR_COST   = "cost"
+)
+
+// metadata saved as "name=value" attributes after the timestamp of a clean record
+type entryMeta struct {
+	expiry   time.Time    // zero if never expire
+	checksum ChecksumType // CHECKSUM_NONE if the values are not verified
+	sums     [][]byte     // checksum of each value
+	cost     float64      // given by SetCost, 0 if not set
+	policy   string       // EntryState of the eviction policy, only set in records
+}
+
+func (meta *entryMeta) entryCost() float64 {
+	if meta.cost <= 0 {
+		return DEFAULT_COST
+	}
+	return meta.cost
+}
+
+func (meta *entryMeta) attrs() string {
+	line := ""
+	if !meta.expiry.IsZero() {
+		line += fmt.Sprintf(" %s=%d", ATTR_EXPIRE, meta.expiry.UnixMilli())
+	}
+	line += meta.sumAttr()
+	if meta.cost > 0 {
+		line += fmt.Sprintf(" %s=%s", ATTR_COST, strconv.FormatFloat(meta.cost, 'g', -1, 64))
+	}
+	if meta.policy != "" {
+		line += fmt.Sprintf(" %s=%s", ATTR_POLICY, escapeJournalKey(meta.policy))
+	}
+	return line
+}
+
+func parseEntryMeta(attrs []string) (entryMeta, error) {
+	meta := entryMeta{}
+	for _, attr := range attrs {
+		name, value, ok := strings.Cut(attr, "=")
+		if !ok {
+			return meta, NewJournalFileFormatError()
+		}
+		switch name {
+		case ATTR_EXPIRE:
+			ms, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return meta, NewJournalFileFormatError()
+			}
+			meta.expiry = time.UnixMilli(ms)
+		case ATTR_SUM:
+			if err := meta.parseSumAttr(value); err != nil {
+				return meta, err
+			}
+		case ATTR_COST:
+			cost, err := strconv.ParseFloat(value, 64)
+			if err != nil || cost < 0 {
+				return meta, NewJournalFileFormatError()
+			}
+			meta.cost = cost
+		case ATTR_POLICY:
+			state, err := unescapeJournalKey(value)
+			if err != nil {
+				return meta, NewJournalFileFormatError()
+			}
+			meta.policy = state
+		default:
+			// attributes of newer versions are ignored
+		}
+	}
+	return meta, nil
+}
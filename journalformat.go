@@ -0,0 +1,430 @@
+package disklrucache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type JournalFormat int
+
+const (
+	// one record per line, see journalHeader. an unterminated line at the end is truncated when opened
+	JOURNAL_TEXT JournalFormat = iota
+	// length prefixed records with a crc32c, a torn record at the end is truncated when opened
+	JOURNAL_BINARY
+)
+
+const (
+	// first line of a binary journal, the number is the version of the record encoding
+	FILE_HEAD_BINARY = "go-disklrucache-binary 1"
+	// a record is much smaller, a larger length means the journal is broken
+	MAX_BINARY_RECORD_SIZE = 1 << 20
+)
+
+func (format JournalFormat) String() string {
+	switch format {
+	case JOURNAL_TEXT:
+		return "text"
+	case JOURNAL_BINARY:
+		return "binary"
+	}
+	return "unknown"
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// operator codes of binary records
+var binaryOperators = []string{"", DIRTY, CLEAN, DEL, READ}
+
+type journalRecord struct {
+	operator string
+	key      string
+	sizes    []int64 // clean only
+	time     time.Time
+	meta     entryMeta
+}
+
+func (cache *DiskLRUCache) keyLine(operator string, key string) string {
+	return encodeRecord(cache.journalFormat, journalRecord{operator: operator, key: key})
+}
+
+func (entry *CacheEntry) cleanRecord() journalRecord {
+	record := journalRecord{operator: CLEAN, key: entry.key, sizes: entry.sizes, time: entry.time, meta: entry.meta}
+	record.meta.policy = entry.base.entryPolicyState(entry.key)
+	return record
+}
+
+func encodeRecord(format JournalFormat, record journalRecord) string {
+	if format == JOURNAL_BINARY {
+		return string(binaryFrame(binaryPayload(record)))
+	}
+	return encodeTextRecord(record, escapeJournalKey(record.key))
+}
+
+// a text record with key written as it is, escaped unless the journal is legacy
+func encodeTextRecord(record journalRecord, key string) string {
+	line := record.operator + " " + key
+	if record.operator != CLEAN {
+		return line + "\n"
+	}
+	for _, size := range record.sizes {
+		line += " " + strconv.FormatInt(size, 10)
+	}
+	return fmt.Sprintf("%s %d%s\n", line, record.time.UnixMilli(), record.meta.attrs())
+}
+
+// the head lines of a journal
+func journalHead(format JournalFormat, header journalHeader) string {
+	if format == JOURNAL_BINARY {
+		return FILE_HEAD_BINARY + "\n" + string(binaryFrame([]byte(header.String())))
+	}
+	return fmt.Sprintf("%s\n%s\n", FILE_HEAD, header)
+}
+
+// operator code, key length, key, and for clean records the sizes, timestamp and attributes
+func binaryPayload(record journalRecord) []byte {
+	payload := make([]byte, 0, 32+len(record.key))
+	for code, operator := range binaryOperators {
+		if operator == record.operator && code > 0 {
+			payload = append(payload, byte(code))
+		}
+	}
+	payload = binary.AppendUvarint(payload, uint64(len(record.key)))
+	payload = append(payload, record.key...)
+	if record.operator != CLEAN {
+		return payload
+	}
+	payload = binary.AppendUvarint(payload, uint64(len(record.sizes)))
+	for _, size := range record.sizes {
+		payload = binary.AppendUvarint(payload, uint64(size))
+	}
+	payload = binary.AppendVarint(payload, record.time.UnixMilli())
+	attrs := strings.TrimSpace(record.meta.attrs())
+	payload = binary.AppendUvarint(payload, uint64(len(attrs)))
+	return append(payload, attrs...)
+}
+
+// length of payload, payload, crc32c of payload
+func binaryFrame(payload []byte) []byte {
+	frame := binary.AppendUvarint(make([]byte, 0, len(payload)+9), uint64(len(payload)))
+	frame = append(frame, payload...)
+	return binary.LittleEndian.AppendUint32(frame, crc32.Checksum(payload, crc32c))
+}
+
+type journalReader interface {
+	// return io.EOF after the last record
+	next() (journalRecord, error)
+	// error describing the record returned by the last next
+	recordError(msg string) *JournalFileFormatError
+}
+
+// read the head of the journal and return the reader of its records
+func newJournalReader(file io.Reader) (journalHeader, journalReader, error) {
+	var header journalHeader
+	reader := bufio.NewReader(file)
+	line, isPrefix, err := reader.ReadLine()
+	if err != nil || isPrefix {
+		return header, nil, NewJournalFileFormatError()
+	}
+	switch string(line) {
+	case FILE_HEAD:
+		line, isPrefix, err = reader.ReadLine()
+		if err != nil || isPrefix {
+			return header, nil, NewJournalFileFormatError()
+		}
+		header, err = parseJournalHeader(string(line))
+		if err != nil {
+			return header, nil, newJournalLineError(2, line)
+		}
+		header.format = JOURNAL_TEXT
+		offset := int64(len(FILE_HEAD) + len(line) + 2)
+		// keys of legacy journals are written as they are
+		rawKeys := header.keyMapper == LEGACY_KEY_MAPPER
+		return header, &textJournalReader{reader: reader, valueCount: header.valueCount, lineNum: 2, offset: offset,
+			rawKeys: rawKeys}, nil
+	case FILE_HEAD_BINARY:
+		binaryReader := &binaryJournalReader{reader: reader, offset: int64(len(line)) + 1}
+		payload, err := binaryReader.frame()
+		if err != nil {
+			return header, nil, NewJournalFileFormatErrorWithMsg(fmt.Sprintf("bad binary journal header,err:%s", err))
+		}
+		header, err = parseJournalHeader(string(payload))
+		if err != nil {
+			return header, nil, NewJournalFileFormatErrorWithMsg(fmt.Sprintf("bad binary journal header %q", payload))
+		}
+		header.format = JOURNAL_BINARY
+		binaryReader.valueCount = header.valueCount
+		return header, binaryReader, nil
+	}
+	return header, nil, NewJournalFileFormatErrorWithMsg(fmt.Sprintf("unknown journal head:%q", line))
+}
+
+type textJournalReader struct {
+	reader     *bufio.Reader
+	valueCount int
+	lineNum    int
+	line       []byte
+	offset     int64 // end of the last line
+	rawKeys    bool
+}
+
+func newJournalLineError(lineNum int, line []byte) *JournalFileFormatError {
+	return NewJournalFileFormatErrorWithMsg(fmt.Sprintf("bad journal line %d:%q", lineNum, line))
+}
+
+func (r *textJournalReader) recordError(msg string) *JournalFileFormatError {
+	if msg == "" {
+		return newJournalLineError(r.lineNum, r.line)
+	}
+	return NewJournalFileFormatErrorWithMsg(fmt.Sprintf("%s at line %d", msg, r.lineNum))
+}
+
+func (r *textJournalReader) next() (journalRecord, error) {
+	var record journalRecord
+	line, err := r.reader.ReadSlice('\n')
+	if err == io.EOF && len(line) == 0 {
+		return record, io.EOF
+	}
+	start := r.offset
+	r.offset += int64(len(line))
+	r.lineNum++
+	r.line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+	if err == io.EOF {
+		// a line being appended by the writer or torn by a crash, the journal is good until its start
+		err := r.recordError("unterminated line")
+		err.goodSize = start
+		return record, err
+	}
+	if err != nil {
+		return record, r.recordError("")
+	}
+	line = r.line
+	strs := strings.Split(strings.TrimSpace(string(line)), " ")
+	if len(strs) < 2 {
+		return record, r.recordError("")
+	}
+	record.operator = strs[0]
+	if r.rawKeys {
+		record.key = strs[1]
+	} else if record.key, err = unescapeJournalKey(strs[1]); err != nil {
+		return record, r.recordError("")
+	}
+	switch record.operator {
+	case DIRTY, DEL, READ:
+		return record, nil
+	case CLEAN:
+	default:
+		return record, r.recordError(fmt.Sprintf("unknown journal operator %q", record.operator))
+	}
+	if len(strs) < 3+r.valueCount {
+		return record, r.recordError("")
+	}
+	if record.meta, err = parseEntryMeta(strs[3+r.valueCount:]); err != nil {
+		return record, r.recordError("")
+	}
+	record.sizes = make([]int64, r.valueCount)
+	for i := range record.sizes {
+		if record.sizes[i], err = strconv.ParseInt(strs[2+i], 10, 64); err != nil {
+			return record, r.recordError("")
+		}
+	}
+	timeStamp, err := strconv.ParseInt(strs[2+r.valueCount], 10, 64)
+	if err != nil {
+		return record, r.recordError("")
+	}
+	record.time = time.UnixMilli(timeStamp)
+	return record, nil
+}
+
+type binaryJournalReader struct {
+	reader     *bufio.Reader
+	valueCount int
+	offset     int64 // end of the last good record
+	start      int64 // start of the record returned by the last next
+}
+
+func (r *binaryJournalReader) recordError(msg string) *JournalFileFormatError {
+	if msg == "" {
+		msg = "bad journal record"
+	}
+	return NewJournalFileFormatErrorWithMsg(fmt.Sprintf("%s at offset %d", msg, r.start))
+}
+
+// an error of the record integrity, the journal is good until its start
+func (r *binaryJournalReader) tornError(msg string) *JournalFileFormatError {
+	err := r.recordError(msg)
+	err.goodSize = r.start
+	return err
+}
+
+// read a frame and check its crc, return io.EOF at the end of journal
+func (r *binaryJournalReader) frame() ([]byte, error) {
+	r.start = r.offset
+	counter := &countingByteReader{reader: r.reader}
+	length, err := binary.ReadUvarint(counter)
+	if err == io.EOF && counter.n == 0 {
+		return nil, io.EOF
+	}
+	if err != nil || length > MAX_BINARY_RECORD_SIZE {
+		return nil, r.tornError("bad record length")
+	}
+	frame := make([]byte, length+4)
+	if _, err := io.ReadFull(r.reader, frame); err != nil {
+		return nil, r.tornError("torn record")
+	}
+	payload := frame[:length]
+	if binary.LittleEndian.Uint32(frame[length:]) != crc32.Checksum(payload, crc32c) {
+		return nil, r.tornError("bad record checksum")
+	}
+	r.offset += int64(counter.n) + int64(len(frame))
+	return payload, nil
+}
+
+func (r *binaryJournalReader) next() (journalRecord, error) {
+	var record journalRecord
+	payload, err := r.frame()
+	if err != nil {
+		return record, err
+	}
+	reader := bytes.NewReader(payload)
+	code, err := reader.ReadByte()
+	if err != nil || int(code) >= len(binaryOperators) || code == 0 {
+		return record, r.recordError(fmt.Sprintf("unknown journal operator %d", code))
+	}
+	record.operator = binaryOperators[code]
+	if record.key, err = readBinaryString(reader); err != nil {
+		return record, r.recordError("")
+	}
+	if record.operator != CLEAN {
+		return record, nil
+	}
+	count, err := binary.ReadUvarint(reader)
+	if err != nil || count != uint64(r.valueCount) {
+		return record, r.recordError("")
+	}
+	record.sizes = make([]int64, count)
+	for i := range record.sizes {
+		size, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return record, r.recordError("")
+		}
+		record.sizes[i] = int64(size)
+	}
+	timeStamp, err := binary.ReadVarint(reader)
+	if err != nil {
+		return record, r.recordError("")
+	}
+	record.time = time.UnixMilli(timeStamp)
+	attrs, err := readBinaryString(reader)
+	if err != nil {
+		return record, r.recordError("")
+	}
+	if record.meta, err = parseEntryMeta(strings.Fields(attrs)); err != nil {
+		return record, r.recordError("")
+	}
+	return record, nil
+}
+
+func readBinaryString(reader *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil || length > uint64(reader.Len()) {
+		return "", NewJournalFileFormatError()
+	}
+	str := make([]byte, length)
+	reader.Read(str)
+	return string(str), nil
+}
+
+type countingByteReader struct {
+	reader io.ByteReader
+	n      int
+}
+
+func (r *countingByteReader) ReadByte() (byte, error) {
+	c, err := r.reader.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return c, err
+}
+
+// the good part of a binary journal with a torn record at the end, 0 if err is not a torn record
+func journalGoodSize(err error) int64 {
+	var formatErr *JournalFileFormatError
+	if errors.As(err, &formatErr) {
+		return formatErr.goodSize
+	}
+	return 0
+}
+
+// ConvertJournal rewrites the journal in dir to format keeping every record, the old one is kept as journal.bak.
+// The cache must not be opened, a cache opened with another format converts the journal itself.
+func ConvertJournal(dir string, format JournalFormat) error {
+	lock, err := lockDir(dir, false, 0, DEFAULT_FILE_MODE)
+	if err != nil {
+		return err
+	}
+	defer unlockDir(lock)
+	name := filepath.Join(dir, JOURNAL_FILENAME)
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	header, reader, err := newJournalReader(file)
+	if err != nil {
+		return err
+	}
+	if header.format == format {
+		return nil
+	}
+	tmpName := filepath.Join(dir, JOURNAL_TMP_FILENAME)
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	writer.WriteString(journalHead(format, header))
+	for {
+		record, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpName)
+			return err
+		}
+		line := encodeRecord(format, record)
+		if format == JOURNAL_TEXT && header.keyMapper == LEGACY_KEY_MAPPER {
+			// the text reader does not unescape the keys of a legacy journal
+			line = encodeTextRecord(record, record.key)
+		}
+		writer.WriteString(line)
+	}
+	err = firstError(writer.Flush(), tmp.Sync(), tmp.Close())
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	file.Close()
+	if err := renameFile(name, filepath.Join(dir, JOURNAL_BACKUP_FILE), true); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return renameFile(tmpName, name, true)
+}
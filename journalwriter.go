@@ -0,0 +1,66 @@
+package disklrucache
+
+import (
+	"bufio"
+	"os"
+	"time"
+)
+
+const (
+	DEFAULT_JOURNAL_BUFFER_SIZE = 32 * 1024
+	DEFAULT_FLUSH_INTERVAL      = time.Second
+)
+
+// records are buffered in memory, dirty and clean records are flushed at once
+// so a crashed process does not leave files unknown by the journal,
+// read and del records wait for the buffer to fill, the flush interval or Flush
+func (cache *DiskLRUCache) setJournal(file *os.File) {
+	cache.journalFile = file
+	cache.journalWriter = bufio.NewWriterSize(file, cache.journalBufferSize)
+}
+
+// flush and close the journal, need lock manually
+func (cache *DiskLRUCache) closeJournal() error {
+	if cache.journalFile == nil {
+		return nil
+	}
+	err := cache.journalWriter.Flush()
+	err = firstError(err, cache.journalFile.Close())
+	cache.journalFile = nil
+	cache.journalWriter = nil
+	return err
+}
+
+// need lock manually
+func (cache *DiskLRUCache) flushJournal() error {
+	if cache.journalWriter == nil {
+		return nil
+	}
+	return cache.journalWriter.Flush()
+}
+
+// Flush writes the buffered journal records to the journal file, it does not sync the file
+func (cache *DiskLRUCache) Flush() error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.flushJournal()
+}
+
+func (cache *DiskLRUCache) startFlusher(interval time.Duration, stop chan struct{}) {
+	cache.background.Add(1)
+	go func() {
+		defer cache.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := cache.Flush(); err != nil {
+					cache.logger.Printf("warning: flush journal failed,err:%s", err)
+				}
+			}
+		}
+	}()
+}
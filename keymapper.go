@@ -0,0 +1,218 @@
+package disklrucache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// longest name EscapeKeyMapper returns, leave room for the value index and tmp suffix
+	MAX_ESCAPED_KEY_LENGTH = 200
+	// mapper of the journals written before key mappers, which have no keys attribute
+	LEGACY_KEY_MAPPER = "raw"
+)
+
+// KeyMapper maps a cache key to the name of its file in the cache directory.
+// The name of the mapper is saved in the journal, a cache can not be opened by another mapper.
+type KeyMapper interface {
+	Name() string
+	// return a InvalidKeyError if the key can not be mapped
+	Filename(key string) (string, error)
+}
+
+// ReversibleKeyMapper can map filenames back to keys, so Open can adopt files not known by the journal
+type ReversibleKeyMapper interface {
+	KeyMapper
+	Key(filename string) (string, error)
+}
+
+// EscapeKeyMapper keeps letters, digits, '_' and '-', other bytes are written as %XX,
+// so the key can be read from the filename. The first byte of a reserved name like journal is escaped too.
+// Keys differ only in case share a file on case insensitive file systems, use HashKeyMapper there.
+type EscapeKeyMapper struct{}
+
+func (EscapeKeyMapper) Name() string {
+	return "escape"
+}
+
+func (EscapeKeyMapper) Filename(key string) (string, error) {
+	var builder strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if isFilenameChar(c) {
+			builder.WriteByte(c)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		}
+		if builder.Len() > MAX_ESCAPED_KEY_LENGTH {
+			return "", NewInvalidKeyError(key, "key is too long to escape, use HashKeyMapper")
+		}
+	}
+	name := builder.String()
+	if isReservedFilename(name) {
+		// the files of the cache itself
+		name = fmt.Sprintf("%%%02X", name[0]) + name[1:]
+	}
+	return name, nil
+}
+
+// read the key back from a filename returned by Filename
+func (mapper EscapeKeyMapper) Key(filename string) (string, error) {
+	key, err := unescapeJournalKey(filename)
+	if err != nil {
+		return "", err
+	}
+	if name, err := mapper.Filename(key); err != nil || name != filename {
+		return "", NewInvalidKeyError(key, fmt.Sprintf("%q is not a filename of escape mapper", filename))
+	}
+	return key, nil
+}
+
+// HashKeyMapper names files by the sha256 of the key, any key is accepted
+type HashKeyMapper struct{}
+
+func (HashKeyMapper) Name() string {
+	return "hash"
+}
+
+func (HashKeyMapper) Filename(key string) (string, error) {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// legacyKeyMapper names files by the key itself like the journals without keys attribute,
+// a read-only cache uses it to read them, a writer migrates the files to its own mapper
+type legacyKeyMapper struct{}
+
+func (legacyKeyMapper) Name() string {
+	return LEGACY_KEY_MAPPER
+}
+
+func (legacyKeyMapper) Filename(key string) (string, error) {
+	return key, nil
+}
+
+func isFilenameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// map the key by the mapper of cache and make sure the name stays in the cache directory
+func (cache *DiskLRUCache) keyFilename(key string) (string, error) {
+	return mapKeyFilename(cache.keyMapper, key)
+}
+
+func mapKeyFilename(mapper KeyMapper, key string) (string, error) {
+	if key == "" {
+		return "", NewInvalidKeyError(key, "key is empty")
+	}
+	name, err := mapper.Filename(key)
+	if err != nil {
+		return "", err
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) ||
+		filepath.Base(name) != name || isReservedFilename(name) {
+		return "", NewInvalidKeyError(key, fmt.Sprintf("mapper %s returns illegal filename %q", mapper.Name(), name))
+	}
+	return name, nil
+}
+
+// rename the files of entries loaded from a legacy journal to the names of the cache mapper.
+// like migrateLayout, files are moved to staging names first so a new name can not be an old one.
+// entries whose key can not be mapped are removed
+func (cache *DiskLRUCache) migrateKeys() error {
+	stagingName := func(entry *CacheEntry, index int) string {
+		return cache.valueFilename(entry.dir, entry.filename, index) + ".migrate"
+	}
+	var unmapped []string
+	iterator := cache.entries.Iterator()
+	for iterator.Next() {
+		entry := iterator.Value()
+		if _, err := cache.keyFilename(entry.key); err != nil {
+			unmapped = append(unmapped, entry.key)
+			continue
+		}
+		for i := 0; i < cache.valueCount; i++ {
+			oldName := entry.GetCleanFilenameAt(i)
+			if _, err := os.Stat(oldName); err != nil {
+				// never commited
+				continue
+			}
+			if err := renameFile(oldName, stagingName(entry, i), true); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range unmapped {
+		entry := cache.entries.Del(key)
+		cache.logger.Printf("warning: remove %q of legacy journal,key can not be mapped by %s", key, cache.keyMapper.Name())
+		entry.removeFiles()
+		cache.curSize -= entry.size
+	}
+	iterator = cache.entries.Iterator()
+	for iterator.Next() {
+		entry := iterator.Value()
+		staging := make([]string, cache.valueCount)
+		for i := range staging {
+			staging[i] = stagingName(entry, i)
+		}
+		entry.filename, _ = cache.keyFilename(entry.key)
+		for i, name := range staging {
+			if _, err := os.Stat(name); err != nil {
+				continue
+			}
+			if err := renameFile(name, entry.GetCleanFilenameAt(i), true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isReservedFilename(name string) bool {
+	switch name {
+	case JOURNAL_FILENAME, JOURNAL_TMP_FILENAME, JOURNAL_BACKUP_FILE, LOCK_FILENAME:
+		return true
+	}
+	return false
+}
+
+// keys are written to journal with '%', spaces, control and non ascii bytes escaped as %XX
+func escapeJournalKey(key string) string {
+	var builder strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c == '%' || c <= ' ' || c >= 0x7f {
+			fmt.Fprintf(&builder, "%%%02X", c)
+		} else {
+			builder.WriteByte(c)
+		}
+	}
+	return builder.String()
+}
+
+func unescapeJournalKey(str string) (string, error) {
+	if !strings.Contains(str, "%") {
+		return str, nil
+	}
+	var builder strings.Builder
+	for i := 0; i < len(str); i++ {
+		if str[i] != '%' {
+			builder.WriteByte(str[i])
+			continue
+		}
+		if i+2 >= len(str) {
+			return "", NewJournalFileFormatErrorWithMsg(fmt.Sprintf("bad escaped key %q", str))
+		}
+		b, err := hex.DecodeString(str[i+1 : i+3])
+		if err != nil {
+			return "", NewJournalFileFormatErrorWithMsg(fmt.Sprintf("bad escaped key %q", str))
+		}
+		builder.WriteByte(b[0])
+		i += 2
+	}
+	return builder.String(), nil
+}
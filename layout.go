@@ -0,0 +1,130 @@
+package disklrucache
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	// each level is a directory named by one byte of the key hash, 256 directories per level
+	MAX_SHARD_LEVELS = 4
+)
+
+// the directory of key relative to cache path, "" for flat layout
+func shardDir(key string, levels int) string {
+	if levels == 0 {
+		return ""
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	sum := hash.Sum(nil)
+	dirs := make([]string, levels)
+	for i := range dirs {
+		dirs[i] = hex.EncodeToString(sum[i : i+1])
+	}
+	return filepath.Join(dirs...)
+}
+
+func isShardDirName(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+func (cache *DiskLRUCache) valueFilename(dir string, filename string, index int) string {
+	name := filepath.Join(cache.cachePath, dir, filename)
+	if cache.valueCount == 1 {
+		return name
+	}
+	return name + "." + strconv.Itoa(index)
+}
+
+// create the shard directory of entry before writing into it
+func (entry *CacheEntry) makeDir() error {
+	if entry.dir == "" {
+		return nil
+	}
+	return os.MkdirAll(filepath.Join(entry.base.cachePath, entry.dir), entry.base.dirMode)
+}
+
+// remove the shard directories of entry if they become empty
+func (entry *CacheEntry) removeEmptyDirs() {
+	dir := entry.dir
+	for dir != "" && dir != "." {
+		if os.Remove(filepath.Join(entry.base.cachePath, dir)) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// move entry files from the layout of fromLevels to the current layout.
+// files are moved to the cache directory first, so a file can not block the creation of a shard directory
+func (cache *DiskLRUCache) migrateLayout(fromLevels int) error {
+	stagingName := func(entry *CacheEntry, index int) string {
+		return cache.valueFilename("", entry.filename, index) + ".migrate"
+	}
+	iterator := cache.entries.Iterator()
+	for iterator.Next() {
+		entry := iterator.Value()
+		oldDir := shardDir(entry.key, fromLevels)
+		for i := 0; i < cache.valueCount; i++ {
+			oldName := cache.valueFilename(oldDir, entry.filename, i)
+			if _, err := os.Stat(oldName); err != nil {
+				// moved by an interrupted migration or never commited
+				continue
+			}
+			if err := renameFile(oldName, stagingName(entry, i), true); err != nil {
+				return err
+			}
+		}
+	}
+	if err := removeEmptyShardDirs(cache.cachePath); err != nil {
+		return err
+	}
+	iterator = cache.entries.Iterator()
+	for iterator.Next() {
+		entry := iterator.Value()
+		for i := 0; i < cache.valueCount; i++ {
+			name := stagingName(entry, i)
+			if _, err := os.Stat(name); err != nil {
+				continue
+			}
+			if err := entry.makeDir(); err != nil {
+				return err
+			}
+			if err := renameFile(name, entry.GetCleanFilenameAt(i), true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// remove empty shard directories under dir, return the first error except not empty
+func removeEmptyShardDirs(dir string) error {
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if !item.IsDir() || !isShardDirName(item.Name()) {
+			continue
+		}
+		sub := filepath.Join(dir, item.Name())
+		if err := removeEmptyShardDirs(sub); err != nil {
+			return err
+		}
+		if rest, err := os.ReadDir(sub); err == nil && len(rest) == 0 {
+			if err := os.Remove(sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -20,6 +20,14 @@ func (l *LinkedHashList[T]) Get(key string) *T {
 	return nil
 }
 
+// get without changing the order
+func (l *LinkedHashList[T]) Peek(key string) *T {
+	if node, ok := l.data_map[key]; ok {
+		return &node.val
+	}
+	return nil
+}
+
 func (l *LinkedHashList[T]) Set(key string, value T) *DoublyLinkedListNode[T] {
 	val, ok := l.data_map[key]
 	if ok {
@@ -36,6 +44,14 @@ func (l *LinkedHashList[T]) Pop() *T {
 	return &node.val
 }
 
+// get the key and value at head without removing it, nil if empty
+func (l *LinkedHashList[T]) Front() (string, *T) {
+	if l.data_list.head == nil {
+		return "", nil
+	}
+	return l.data_list.head.key, &l.data_list.head.val
+}
+
 func (l *LinkedHashList[T]) Del(key string) *T {
 	if node, ok := l.data_map[key]; ok {
 		l.data_list.Del(node)
@@ -65,6 +81,10 @@ func (l *LinkedHashListIterator[T]) Value() *T {
 	return &l.cur.val
 }
 
+func (l *LinkedHashListIterator[T]) Key() string {
+	return l.cur.key
+}
+
 func (l *LinkedHashList[T]) Iterator() LinkedHashListIterator[T] {
 	return LinkedHashListIterator[T]{
 		cur: &DoublyLinkedListNode[T]{next: l.data_list.head, prev: nil},
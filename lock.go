@@ -0,0 +1,62 @@
+package disklrucache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// advisory lock of the cache directory, its content is not used
+	LOCK_FILENAME = "journal.lock"
+	// how often a locked directory is tried again while waiting
+	lockRetryInterval = 10 * time.Millisecond
+)
+
+// returned by Open when another process or cache holds the directory
+var ErrCacheLocked = errors.New("cache directory is locked by another cache")
+
+// returned by Open with Options.SharedLock when the directory has no lock file to lock
+var ErrNoLockFile = errors.New("cache directory has no lock file, it is created when a writer opens the cache")
+
+// take the lock of dir, shared locks are held together by readers.
+// wait up to timeout if it is held by others, the lock is released when the file is closed.
+// a reader does not create the lock file, it returns ErrNoLockFile if no writer has created it
+func lockDir(dir string, shared bool, timeout time.Duration, mode os.FileMode) (*os.File, error) {
+	flag := os.O_CREATE | os.O_RDWR
+	if shared {
+		// readers may not be allowed to write the directory
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(filepath.Join(dir, LOCK_FILENAME), flag, mode)
+	if shared && os.IsNotExist(err) {
+		return nil, ErrNoLockFile
+	}
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		locked, err := tryLockFile(file, shared)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if locked {
+			return file, nil
+		}
+		if !time.Now().Before(deadline) {
+			file.Close()
+			return nil, ErrCacheLocked
+		}
+		time.Sleep(min(lockRetryInterval, time.Until(deadline)))
+	}
+}
+
+func unlockDir(file *os.File) error {
+	if file == nil {
+		return nil
+	}
+	return firstError(unlockFile(file), file.Close())
+}
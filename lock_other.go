@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly || illumos) && !windows
+
+package disklrucache
+
+import "os"
+
+// the platform has no flock, like solaris and aix, caches are not protected from each other
+func tryLockFile(file *os.File, shared bool) (bool, error) {
+	return true, nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,148 @@
+package disklrucache
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	DEFAULT_FILE_MODE os.FileMode = 0666
+)
+
+// Logger receives the warnings the cache used to print with the log package,
+// *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Clock is the time source of the cache, replace it in tests
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type Options struct {
+	AppVersion   int
+	CacheVersion int
+	// max bytes of all entries, must be larger than 0
+	MaxSize int64
+	// max number of entries including the ones being created, evicted like MaxSize. 0 is not limited
+	MaxEntries int
+	// number of values of each entry, default is 1
+	ValueCount int
+	// permission of created files, directories get the execute bits added
+	FileMode os.FileMode
+	// default is log.Default()
+	Logger Logger
+	// default is the system clock
+	Clock Clock
+	// levels of directories the entry files are spread into, 0 keeps all files in the cache directory.
+	// an existing cache is migrated when opened with other levels
+	ShardLevels int
+	// map keys to filenames, default is EscapeKeyMapper.
+	// the files of a journal written before key mappers are migrated to it when opened
+	KeyMapper KeyMapper
+	// remove expired entries in background every interval, 0 only removes them when read
+	SweepInterval time.Duration
+	// what to do when the journal is corrupt or has another version, default is RECOVERY_FAIL
+	Recovery RecoveryPolicy
+	// rewrite the journal in background when it has this many redundant records and more than entries,
+	// default is DEFAULT_COMPACT_THRESHOLD, negative disables it
+	CompactThreshold int
+	// format of a new journal, an existing journal of the other format is converted when opened
+	JournalFormat JournalFormat
+	// when commits reach the disk, default is DURABILITY_NONE
+	Durability Durability
+	// interval of DURABILITY_PERIODIC, default is DEFAULT_SYNC_INTERVAL
+	SyncInterval time.Duration
+	// bytes of journal records buffered in memory, default is DEFAULT_JOURNAL_BUFFER_SIZE
+	JournalBufferSize int
+	// flush the buffered journal records every interval, default is DEFAULT_FLUSH_INTERVAL,
+	// negative writes every record at once
+	FlushInterval time.Duration
+	// hash values while they are written and verify them when read to the end, default is CHECKSUM_NONE
+	Checksum ChecksumType
+	// what Open does with files in the cache directory not known by the journal, default is UNKNOWN_FILES_KEEP
+	UnknownFiles UnknownFilePolicy
+	// how long Open waits for another cache to release the directory, 0 fails with ErrCacheLocked at once
+	LockTimeout time.Duration
+	// replay the journal without writing to the directory: no journal records, no eviction,
+	// Edit and Remove fail with ErrReadOnly. The max size, shard levels and format of the journal are used,
+	// RECOVERY_TRUNCATE keeps the records before a bad one, other policies fail.
+	// Changes of the writer after Open are not seen
+	ReadOnly bool
+	// choose the entries evicted when the cache is full, default evicts the least recently used without
+	// another list. The policy is saved in the journal header, an existing cache of another policy keeps
+	// its entries but starts the new policy from their LRU order
+	EvictionPolicy EvictionPolicy
+	// consulted when the commit of a new key needs an eviction, the key is kept out unless the filter
+	// admits it over the entry evicted next. default nil admits every key
+	Admission AdmissionFilter
+	// a commit kept out by Admission returns nil instead of ErrNotAdmitted
+	DiscardNotAdmitted bool
+	// take a shared lock in read-only mode, so no writer opens the cache until it is closed.
+	// the lock file is not created, Open returns ErrNoLockFile if no writer has created it
+	SharedLock bool
+}
+
+func (opts *Options) withDefaults() Options {
+	rst := *opts
+	if rst.FileMode == 0 {
+		rst.FileMode = DEFAULT_FILE_MODE
+	}
+	if rst.ValueCount == 0 {
+		rst.ValueCount = 1
+	}
+	if rst.KeyMapper == nil {
+		rst.KeyMapper = EscapeKeyMapper{}
+	}
+	if rst.Logger == nil {
+		rst.Logger = log.Default()
+	}
+	if rst.Clock == nil {
+		rst.Clock = systemClock{}
+	}
+	if rst.JournalBufferSize <= 0 {
+		rst.JournalBufferSize = DEFAULT_JOURNAL_BUFFER_SIZE
+	}
+	if rst.FlushInterval == 0 {
+		rst.FlushInterval = DEFAULT_FLUSH_INTERVAL
+	}
+	if rst.SyncInterval == 0 {
+		rst.SyncInterval = DEFAULT_SYNC_INTERVAL
+	}
+	if rst.CompactThreshold == 0 {
+		rst.CompactThreshold = DEFAULT_COMPACT_THRESHOLD
+	}
+	return rst
+}
+
+func (opts *Options) validate() error {
+	if opts.MaxSize <= 0 {
+		return NewIllegalArgumentError("max size must be larger than 0")
+	}
+	if opts.MaxEntries < 0 {
+		return NewIllegalArgumentError("max entries must not be negative")
+	}
+	if opts.ShardLevels < 0 || opts.ShardLevels > MAX_SHARD_LEVELS {
+		return NewIllegalArgumentError(fmt.Sprintf("shard levels must be in [0,%d]", MAX_SHARD_LEVELS))
+	}
+	if opts.ValueCount < 1 {
+		return NewIllegalArgumentError("value count must be larger than 0")
+	}
+	return nil
+}
+
+// mode for directories created by the cache
+func (opts *Options) dirMode() os.FileMode {
+	mode := opts.FileMode.Perm()
+	// give search permission to whoever can read
+	return mode | (mode&0444)>>2
+}
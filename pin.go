@@ -0,0 +1,61 @@
+package disklrucache
+
+import (
+	"fmt"
+)
+
+// Pin keeps the commited entry of key from being evicted when the cache is full until Unpin is called
+// as many times. Remove, expiry and corruption still remove a pinned entry, pins are not saved in journal.
+// Return false if key has no commited entry
+func (cache *DiskLRUCache) Pin(key string) (bool, error) {
+	if _, err := cache.keyFilename(key); err != nil {
+		return false, err
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.checkNotClosed()
+	entry := cache.entries.Peek(key)
+	if entry == nil || !entry.readable {
+		return false, nil
+	}
+	entry.pins++
+	if entry.pins == 1 {
+		cache.pinnedSize += entry.size
+		cache.pinnedEntries++
+	}
+	return true, nil
+}
+
+// Unpin releases a pin taken by Pin, the entry can be evicted again when all pins are released.
+// The eviction policy keeps tracking a pinned entry, so it is evicted where the policy places it
+func (cache *DiskLRUCache) Unpin(key string) error {
+	if _, err := cache.keyFilename(key); err != nil {
+		return err
+	}
+	cache.lock.Lock()
+	defer cache.unlockAndNotify()
+	cache.checkNotClosed()
+	entry := cache.entries.Peek(key)
+	if entry == nil || entry.pins == 0 {
+		return NewIllegalStateError(fmt.Sprintf("cache %q is not pinned", key))
+	}
+	entry.pins--
+	if entry.pins == 0 {
+		cache.pinnedSize -= entry.size
+		cache.pinnedEntries--
+		if !cache.readOnly {
+			// evictions skipped while it was pinned
+			cache.checkFull()
+		}
+	}
+	return nil
+}
+
+// forget the pins of an entry leaving the cache, need lock manually
+func (cache *DiskLRUCache) dropPins(entry *CacheEntry) {
+	if entry.pins > 0 {
+		cache.pinnedSize -= entry.size
+		cache.pinnedEntries--
+		entry.pins = 0
+	}
+}
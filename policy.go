@@ -0,0 +1,300 @@
+package disklrucache
+
+import (
+	"sort"
+	"strconv"
+)
+
+// EvictionPolicy chooses the entries evicted when the cache is full. It only knows commited entries,
+// the methods are called under the cache lock, so a policy must not be shared by caches
+type EvictionPolicy interface {
+	// saved in the journal header, the entry states of a journal written by another policy are dropped
+	Name() string
+	// a value of key is commited, key is already known if its old value is replaced
+	OnInsert(key string, size int64)
+	// the value of key is read by Get
+	OnAccess(key string)
+	// key leaves the cache, the policy may not know it
+	OnRemove(key string)
+	// the key to evict next other than the keys skip returns true for, which are pinned.
+	// skip may be nil, false if no key is left
+	Victim(skip func(key string) bool) (string, bool)
+	// state of key saved in its clean journal record, "" if the order of the records is enough
+	EntryState(key string) string
+	// called instead of OnInsert for the entries of the journal when the cache is opened, from the least
+	// recently used to the most. state is "" if the journal has no state of this policy
+	RestoreEntry(key string, size int64, state string)
+}
+
+// SizedPolicy is an EvictionPolicy which divides the max size between its segments,
+// SetMaxSize is called when the cache is opened and by DiskLRUCache.SetMaxSize
+type SizedPolicy interface {
+	EvictionPolicy
+	SetMaxSize(maxSize int64)
+}
+
+// need lock manually
+func (cache *DiskLRUCache) policyName() string {
+	if cache.policy == nil {
+		return ""
+	}
+	return cache.policy.Name()
+}
+
+func (cache *DiskLRUCache) setPolicyMaxSize() {
+	if sized, ok := cache.policy.(SizedPolicy); ok {
+		sized.SetMaxSize(cache.maxSize)
+	}
+}
+
+// remove the next entry to evict from the entries, nil if there is none. need lock manually
+func (cache *DiskLRUCache) popVictim() *CacheEntry {
+	if cache.policy == nil {
+		iterator := cache.entries.Iterator()
+		for iterator.Next() {
+			// a new entry being edited has nothing to evict, its commit would be lost
+			if entry := iterator.Value(); entry.pins == 0 && (entry.readable || entry.curEditor == nil) {
+				return cache.entries.Del(entry.key)
+			}
+		}
+		return nil
+	}
+	for {
+		key, ok := cache.policy.Victim(cache.isPinned)
+		if !ok {
+			return nil
+		}
+		cache.policy.OnRemove(key)
+		// a key not in the cache is dropped by the policy
+		if entry := cache.entries.Del(key); entry != nil {
+			return entry
+		}
+	}
+}
+
+// a pinned entry stays in the policy but is never chosen as victim, need lock manually
+func (cache *DiskLRUCache) isPinned(key string) bool {
+	entry := cache.entries.Peek(key)
+	return entry != nil && entry.pins > 0
+}
+
+// the first key of list from the head which is not skipped
+func firstKey[T any](list *LinkedHashList[T], skip func(key string) bool) (string, bool) {
+	iterator := list.Iterator()
+	for iterator.Next() {
+		if key := iterator.Key(); skip == nil || !skip(key) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// need lock manually
+func (cache *DiskLRUCache) policyInsert(entry *CacheEntry) {
+	if policy, ok := cache.policy.(CostPolicy); ok {
+		policy.OnInsertCost(entry.key, entry.size, entry.meta.entryCost())
+	} else if cache.policy != nil {
+		cache.policy.OnInsert(entry.key, entry.size)
+	}
+}
+
+// need lock manually
+func (cache *DiskLRUCache) policyAccess(key string) {
+	if cache.policy != nil {
+		cache.policy.OnAccess(key)
+	}
+}
+
+// need lock manually
+func (cache *DiskLRUCache) policyRemove(key string) {
+	if cache.policy != nil {
+		cache.policy.OnRemove(key)
+	}
+}
+
+// state written in the clean record of key, need lock manually
+func (cache *DiskLRUCache) entryPolicyState(key string) string {
+	if cache.policy == nil {
+		return ""
+	}
+	return cache.policy.EntryState(key)
+}
+
+// hand the loaded entries to the policy in LRU order with the reads replayed after their last commit,
+// journalPolicy is the policy of the journal header
+func (cache *DiskLRUCache) loadPolicy(journalPolicy string) {
+	if cache.policy == nil {
+		return
+	}
+	restore := journalPolicy == cache.policy.Name()
+	iterator := cache.entries.Iterator()
+	for iterator.Next() {
+		entry := iterator.Value()
+		state, reads := entry.policyState, entry.replayReads
+		entry.policyState, entry.replayReads = "", 0
+		if !entry.readable {
+			continue
+		}
+		if !restore {
+			state = ""
+		}
+		if policy, ok := cache.policy.(CostPolicy); ok {
+			policy.RestoreEntryCost(entry.key, entry.size, entry.meta.entryCost(), state)
+		} else {
+			cache.policy.RestoreEntry(entry.key, entry.size, state)
+		}
+		for i := 0; i < reads; i++ {
+			cache.policy.OnAccess(entry.key)
+		}
+	}
+}
+
+// LRUPolicy evicts the least recently used entry, like the cache without a policy
+type LRUPolicy struct {
+	list *LinkedHashList[int64]
+}
+
+func NewLRUPolicy() *LRUPolicy {
+	return &LRUPolicy{list: NewLinkedHashList[int64]()}
+}
+
+func (policy *LRUPolicy) Name() string {
+	return "lru"
+}
+
+func (policy *LRUPolicy) OnInsert(key string, size int64) {
+	policy.list.Set(key, size)
+}
+
+func (policy *LRUPolicy) OnAccess(key string) {
+	policy.list.Get(key)
+}
+
+func (policy *LRUPolicy) OnRemove(key string) {
+	policy.list.Del(key)
+}
+
+func (policy *LRUPolicy) Victim(skip func(key string) bool) (string, bool) {
+	return firstKey(policy.list, skip)
+}
+
+func (policy *LRUPolicy) EntryState(key string) string {
+	return ""
+}
+
+func (policy *LRUPolicy) RestoreEntry(key string, size int64, state string) {
+	policy.list.Set(key, size)
+}
+
+// LFUPolicy evicts the least frequently used entry, the least recently used one of the same frequency first.
+// A commit counts as a use, frequencies never decrease so a burst keeps an entry for long
+type LFUPolicy struct {
+	freqs   map[string]int
+	buckets map[int]*LinkedHashList[int64] // keys of each frequency in LRU order
+	minFreq int
+}
+
+func NewLFUPolicy() *LFUPolicy {
+	return &LFUPolicy{freqs: make(map[string]int), buckets: make(map[int]*LinkedHashList[int64])}
+}
+
+func (policy *LFUPolicy) Name() string {
+	return "lfu"
+}
+
+func (policy *LFUPolicy) OnInsert(key string, size int64) {
+	if _, ok := policy.freqs[key]; ok {
+		policy.touch(key, size)
+		return
+	}
+	policy.add(key, size, 1)
+}
+
+func (policy *LFUPolicy) OnAccess(key string) {
+	if freq, ok := policy.freqs[key]; ok {
+		policy.touch(key, *policy.buckets[freq].Peek(key))
+	}
+}
+
+func (policy *LFUPolicy) OnRemove(key string) {
+	if freq, ok := policy.freqs[key]; ok {
+		policy.del(key, freq)
+	}
+}
+
+func (policy *LFUPolicy) Victim(skip func(key string) bool) (string, bool) {
+	if len(policy.freqs) == 0 {
+		return "", false
+	}
+	if policy.buckets[policy.minFreq] == nil {
+		// the bucket is emptied by a removal
+		policy.minFreq = 0
+		for freq := range policy.buckets {
+			if policy.minFreq == 0 || freq < policy.minFreq {
+				policy.minFreq = freq
+			}
+		}
+	}
+	if key, ok := firstKey(policy.buckets[policy.minFreq], skip); ok {
+		return key, true
+	}
+	// all keys of the lowest frequency are skipped, look in the higher ones
+	freqs := make([]int, 0, len(policy.buckets))
+	for freq := range policy.buckets {
+		if freq > policy.minFreq {
+			freqs = append(freqs, freq)
+		}
+	}
+	sort.Ints(freqs)
+	for _, freq := range freqs {
+		if key, ok := firstKey(policy.buckets[freq], skip); ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func (policy *LFUPolicy) EntryState(key string) string {
+	return strconv.Itoa(policy.freqs[key])
+}
+
+func (policy *LFUPolicy) RestoreEntry(key string, size int64, state string) {
+	freq, err := strconv.Atoi(state)
+	if err != nil || freq < 1 {
+		freq = 1
+	}
+	policy.OnRemove(key)
+	policy.add(key, size, freq)
+}
+
+func (policy *LFUPolicy) add(key string, size int64, freq int) {
+	bucket := policy.buckets[freq]
+	if bucket == nil {
+		bucket = NewLinkedHashList[int64]()
+		policy.buckets[freq] = bucket
+	}
+	bucket.Set(key, size)
+	policy.freqs[key] = freq
+	if len(policy.freqs) == 1 || freq < policy.minFreq {
+		policy.minFreq = freq
+	}
+}
+
+func (policy *LFUPolicy) del(key string, freq int) {
+	bucket := policy.buckets[freq]
+	bucket.Del(key)
+	if bucket.Len() == 0 {
+		delete(policy.buckets, freq)
+	}
+	delete(policy.freqs, key)
+}
+
+// move key to the next frequency
+func (policy *LFUPolicy) touch(key string, size int64) {
+	freq := policy.freqs[key]
+	policy.del(key, freq)
+	policy.add(key, size, freq+1)
+	if policy.buckets[policy.minFreq] == nil && policy.minFreq == freq {
+		policy.minFreq = freq + 1
+	}
+}
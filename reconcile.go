@@ -0,0 +1,275 @@
+package disklrucache
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type UnknownFilePolicy int
+
+const (
+	// leave the files not known by the journal in the cache directory
+	UNKNOWN_FILES_KEEP UnknownFilePolicy = iota
+	UNKNOWN_FILES_DELETE
+	// add the files as entries at the LRU head if their key can be read back by a ReversibleKeyMapper,
+	// other files are kept
+	UNKNOWN_FILES_ADOPT
+)
+
+func (policy UnknownFilePolicy) String() string {
+	switch policy {
+	case UNKNOWN_FILES_KEEP:
+		return "keep"
+	case UNKNOWN_FILES_DELETE:
+		return "delete"
+	case UNKNOWN_FILES_ADOPT:
+		return "adopt"
+	}
+	return "unknown"
+}
+
+// ReconcileReport describes the differences between the journal and the cache directory found by Open
+type ReconcileReport struct {
+	// entries never commited, their files are deleted
+	DirtyEntries int
+	// entries with a value file missing, the other files are deleted
+	MissingEntries int
+	// entries with a value file of other size than the journal, their files are deleted
+	SizeMismatches int
+	// tmp files of editors and link files of readers left by a crash, they are deleted
+	OrphanFiles int
+	// files not known by the journal, deleted or kept by Options.UnknownFiles
+	UnknownFiles int
+	// entries added from unknown files
+	AdoptedEntries int
+}
+
+func (report *ReconcileReport) empty() bool {
+	return *report == ReconcileReport{}
+}
+
+// get the report of the reconciliation done by Open, nil if the journal matched the directory
+func (cache *DiskLRUCache) ReconcileReport() *ReconcileReport {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	return cache.reconcileReport
+}
+
+// tmp files of getAvailableTmpFilename and links of getAvailableLinkname
+var orphanFilePattern = regexp.MustCompile(`\.(tmp|link)[0-9]+$`)
+
+// make the loaded entries match the files in the cache directory, no editor or reader exists yet.
+// return true if the journal has to be rewritten
+func (cache *DiskLRUCache) reconcile() (bool, error) {
+	report := &ReconcileReport{}
+	known := make(map[string]bool)
+	var dropped []*CacheEntry
+	iterator := cache.entries.Iterator()
+	for iterator.Next() {
+		entry := iterator.Value()
+		if !entry.readable {
+			report.DirtyEntries++
+			dropped = append(dropped, entry)
+			continue
+		}
+		if ok := cache.checkEntryFiles(entry, report); !ok {
+			dropped = append(dropped, entry)
+			continue
+		}
+		for i := 0; i < cache.valueCount; i++ {
+			known[entry.GetCleanFilenameAt(i)] = true
+		}
+	}
+	for _, entry := range dropped {
+		cache.entries.Del(entry.key)
+		// files of a dirty entry may be renamed before a crash lost its clean record
+		entry.removeFiles()
+		cache.curSize -= entry.size
+	}
+
+	var unknown []string
+	err := walkCacheFiles(cache.cachePath, 0, func(name string) error {
+		if known[name] {
+			return nil
+		}
+		if orphanFilePattern.MatchString(name) {
+			report.OrphanFiles++
+			return os.Remove(name)
+		}
+		switch cache.unknownFiles {
+		case UNKNOWN_FILES_DELETE:
+			report.UnknownFiles++
+			return os.Remove(name)
+		case UNKNOWN_FILES_ADOPT:
+			unknown = append(unknown, name)
+		default:
+			report.UnknownFiles++
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(unknown) > 0 {
+		if err := cache.adopt(unknown, report); err != nil {
+			return false, err
+		}
+	}
+	if report.empty() {
+		return false, nil
+	}
+	if cache.shardLevels > 0 {
+		if err := removeEmptyShardDirs(cache.cachePath); err != nil {
+			return false, err
+		}
+	}
+	cache.reconcileReport = report
+	cache.logger.Printf("warning: journal reconciled with cache directory, dropped %d dirty, %d missing and %d changed entries,"+
+		" removed %d orphan files, found %d unknown files and adopted %d entries",
+		report.DirtyEntries, report.MissingEntries, report.SizeMismatches, report.OrphanFiles, report.UnknownFiles, report.AdoptedEntries)
+	// unknown files are not in the journal, nothing to rewrite for them
+	return report.DirtyEntries+report.MissingEntries+report.SizeMismatches+report.OrphanFiles+report.AdoptedEntries > 0, nil
+}
+
+// check the value files of entry have the sizes in journal
+func (cache *DiskLRUCache) checkEntryFiles(entry *CacheEntry, report *ReconcileReport) bool {
+	for i := 0; i < cache.valueCount; i++ {
+		info, err := os.Stat(entry.GetCleanFilenameAt(i))
+		if err != nil {
+			report.MissingEntries++
+			return false
+		}
+		if i < len(entry.sizes) && info.Size() != entry.sizes[i] {
+			report.SizeMismatches++
+			return false
+		}
+	}
+	return true
+}
+
+// visit the regular files in dir and its shard directories, the journal files are skipped
+func walkCacheFiles(dir string, depth int, visit func(name string) error) error {
+	items, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		name := filepath.Join(dir, item.Name())
+		if item.IsDir() {
+			if depth < MAX_SHARD_LEVELS && isShardDirName(item.Name()) {
+				if err := walkCacheFiles(name, depth+1, visit); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !item.Type().IsRegular() || depth == 0 && isReservedFilename(item.Name()) {
+			continue
+		}
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add unknown files as entries, the files of a key need all values at its shard directory
+func (cache *DiskLRUCache) adopt(names []string, report *ReconcileReport) error {
+	mapper, ok := cache.keyMapper.(ReversibleKeyMapper)
+	if !ok {
+		report.UnknownFiles += len(names)
+		return nil
+	}
+	type candidate struct {
+		entry CacheEntry
+		files int
+	}
+	candidates := make(map[string]*candidate)
+	for _, name := range names {
+		rel, _ := filepath.Rel(cache.cachePath, name)
+		dir, filename := filepath.Split(rel)
+		dir = filepath.Clean(dir)
+		if dir == "." {
+			dir = ""
+		}
+		index := 0
+		if cache.valueCount > 1 {
+			dot := strings.LastIndexByte(filename, '.')
+			var err error
+			if dot < 0 {
+				index = -1
+			} else if index, err = strconv.Atoi(filename[dot+1:]); err != nil || index >= cache.valueCount {
+				index = -1
+			}
+			filename = filename[:max(dot, 0)]
+		}
+		key, err := mapper.Key(filename)
+		if err == nil && index >= 0 {
+			if mapped, err := cache.keyFilename(key); err != nil || mapped != filename || shardDir(key, cache.shardLevels) != dir {
+				index = -1
+			}
+		}
+		if err != nil || index < 0 || cache.entries.Peek(key) != nil {
+			report.UnknownFiles++
+			continue
+		}
+		c := candidates[key]
+		if c == nil {
+			c = &candidate{entry: CacheEntry{
+				base:     cache,
+				key:      key,
+				filename: filename,
+				dir:      dir,
+				sizes:    make([]int64, cache.valueCount),
+				readable: true,
+			}}
+			candidates[key] = c
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		c.entry.sizes[index] = info.Size()
+		if info.ModTime().After(c.entry.time) {
+			c.entry.time = info.ModTime()
+		}
+		c.files++
+	}
+	var adopted []CacheEntry
+	for _, c := range candidates {
+		if c.files != cache.valueCount {
+			report.UnknownFiles += c.files
+			continue
+		}
+		c.entry.setSizes(c.entry.sizes)
+		c.entry.time = time.UnixMilli(c.entry.time.UnixMilli())
+		c.entry.accessTime = c.entry.time
+		adopted = append(adopted, c.entry)
+	}
+	if len(adopted) == 0 {
+		return nil
+	}
+	// the oldest files are evicted first
+	sort.Slice(adopted, func(i, j int) bool {
+		return adopted[i].time.Before(adopted[j].time)
+	})
+	entries := NewLinkedHashList[CacheEntry]()
+	for _, entry := range adopted {
+		entry.commitId = cache.sequential_id
+		cache.sequential_id++
+		cache.curSize += entry.size
+		entries.Set(entry.key, entry)
+	}
+	iterator := cache.entries.Iterator()
+	for iterator.Next() {
+		entries.Set(iterator.Value().key, *iterator.Value())
+	}
+	cache.entries = *entries
+	report.AdoptedEntries = len(adopted)
+	return nil
+}
@@ -0,0 +1,199 @@
+package disklrucache
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+type RecoveryPolicy int
+
+const (
+	// return the journal error from Open
+	RECOVERY_FAIL RecoveryPolicy = iota
+	// delete everything in the cache directory and start with an empty cache,
+	// like Android's DiskLruCache does when the version changes
+	RECOVERY_RESET
+	// load journal.bak written by RebuildJournal, reset if it is not usable either
+	RECOVERY_BACKUP
+	// keep the records before the first bad line, reset on version mismatch
+	RECOVERY_TRUNCATE
+)
+
+func (policy RecoveryPolicy) String() string {
+	switch policy {
+	case RECOVERY_FAIL:
+		return "fail"
+	case RECOVERY_RESET:
+		return "reset"
+	case RECOVERY_BACKUP:
+		return "backup"
+	case RECOVERY_TRUNCATE:
+		return "truncate"
+	}
+	return "unknown"
+}
+
+// RecoveryReport describes what Open threw away to recover from a bad journal
+type RecoveryReport struct {
+	// the error of reading the journal
+	Cause error
+	// the policy finally applied, backup and truncate fall back to reset
+	Policy RecoveryPolicy
+	// journal lines not applied to the cache
+	DroppedLines int
+	// entries known by the bad journal but not kept, their files are deleted
+	DroppedEntries int
+}
+
+// get the report of the recovery done by Open, nil if the journal was fine
+func (cache *DiskLRUCache) RecoveryReport() *RecoveryReport {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	return cache.recoveryReport
+}
+
+func isJournalError(err error) bool {
+	switch err.(type) {
+	case *JournalFileFormatError, *JournalVersionError:
+		return true
+	}
+	return false
+}
+
+// header and records are read from the journal before the error
+func (cache *DiskLRUCache) recover(cause error, header journalHeader, records int) error {
+	report := &RecoveryReport{Cause: cause, Policy: cache.recoveryPolicy}
+	cache.recoveryReport = report
+	lines := countJournalLines(filepath.Join(cache.cachePath, JOURNAL_FILENAME))
+	_, versionMismatch := cause.(*JournalVersionError)
+
+	if report.Policy == RECOVERY_TRUNCATE && !versionMismatch && records > 0 {
+		report.DroppedLines = lines - records
+		return cache.finishRecover(report, header)
+	}
+	if report.Policy == RECOVERY_BACKUP {
+		broken := cache.entries
+		cache.resetEntries()
+		header, _, err := cache.loadJournal(JOURNAL_BACKUP_FILE)
+		if err == nil {
+			report.DroppedLines = lines
+			iterator := broken.Iterator()
+			for iterator.Next() {
+				entry := iterator.Value()
+				if cache.entries.Peek(entry.key) == nil {
+					entry.removeFiles()
+					report.DroppedEntries++
+				}
+			}
+			// drop the bad journal so the rebuild does not overwrite the backup with it
+			os.Remove(filepath.Join(cache.cachePath, JOURNAL_FILENAME))
+			return cache.finishRecover(report, header)
+		}
+		cache.logger.Printf("warning: backup journal is not usable either,err:%s", err)
+		cache.entries = broken
+	}
+	report.Policy = RECOVERY_RESET
+	report.DroppedLines = lines
+	report.DroppedEntries = cache.entries.Len()
+	if err := cache.reset(); err != nil {
+		return err
+	}
+	cache.logRecover(report)
+	return nil
+}
+
+// write the recovered entries to a new journal
+func (cache *DiskLRUCache) finishRecover(report *RecoveryReport, header journalHeader) error {
+	if _, err := cache.applyHeader(header); err != nil {
+		return err
+	}
+	if _, err := cache.reconcile(); err != nil {
+		return err
+	}
+	cache.loadPolicy(header.policy)
+	if err := cache.rebuildAndShrink(); err != nil {
+		return err
+	}
+	cache.logRecover(report)
+	return nil
+}
+
+func (cache *DiskLRUCache) logRecover(report *RecoveryReport) {
+	cache.logger.Printf("warning: journal recovered by %s, dropped %d lines and %d entries,cause:%s",
+		report.Policy, report.DroppedLines, report.DroppedEntries, report.Cause)
+}
+
+// delete everything in the cache directory and create an empty journal
+func (cache *DiskLRUCache) reset() error {
+	cache.closeJournal()
+	items, err := os.ReadDir(cache.cachePath)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if item.Name() == LOCK_FILENAME {
+			// removing it would let another cache lock the directory
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(cache.cachePath, item.Name())); err != nil {
+			return err
+		}
+	}
+	cache.resetEntries()
+	f, err := cache.newJournal(JOURNAL_FILENAME)
+	if err != nil {
+		return err
+	}
+	cache.setJournal(f)
+	return cache.syncNewJournal(f)
+}
+
+func (cache *DiskLRUCache) resetEntries() {
+	cache.entries = *NewLinkedHashList[CacheEntry]()
+	cache.curSize = 0
+	cache.sequential_id = 1
+	cache.journalRecords = 0
+}
+
+// count the record lines of a journal, the two header lines are not counted.
+// records of a binary journal are counted until the first bad one
+func countJournalLines(filename string) int {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	if header, records, err := newJournalReader(file); err == nil && header.format == JOURNAL_BINARY {
+		lines := 0
+		for _, err := records.next(); err == nil; _, err = records.next() {
+			lines++
+		}
+		return lines
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0
+	}
+	reader := bufio.NewReader(file)
+	lines := 0
+	var last byte = '\n'
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			break
+		}
+		if c == '\n' {
+			lines++
+		}
+		last = c
+	}
+	// the last line has no line break
+	if last != '\n' {
+		lines++
+	}
+	if lines < 2 {
+		return 0
+	}
+	return lines - 2
+}
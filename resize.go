@@ -0,0 +1,28 @@
+package disklrucache
+
+// SetMaxSize changes the max size at runtime, entries are evicted at once by the configured eviction policy
+// (least recently used first without one) until the cache fits. The journal is rewritten so the new size is kept by its header,
+// a later Open with another Options.MaxSize changes it again. Return the number and bytes of evicted entries
+func (cache *DiskLRUCache) SetMaxSize(maxSize int64) (entries int, bytes int64, err error) {
+	if maxSize <= 0 {
+		return 0, 0, NewIllegalArgumentError("max size must be larger than 0")
+	}
+	if cache.readOnly {
+		return 0, 0, ErrReadOnly
+	}
+	cache.lock.Lock()
+	cache.checkNotClosed()
+	evictions, evictionBytes := cache.stats.evictions.Load(), cache.stats.evictionBytes.Load()
+	changed := cache.maxSize != maxSize
+	cache.maxSize = maxSize
+	cache.setPolicyMaxSize()
+	cache.checkFull()
+	// only checkFull evicts, and it needs the lock
+	entries = int(cache.stats.evictions.Load() - evictions)
+	bytes = cache.stats.evictionBytes.Load() - evictionBytes
+	cache.unlockAndNotify()
+	if changed {
+		err = cache.RebuildJournal()
+	}
+	return entries, bytes, err
+}
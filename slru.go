@@ -0,0 +1,142 @@
+package disklrucache
+
+const (
+	// share of the max size kept by the protected segment of SLRUPolicy and TinyLFUPolicy
+	DEFAULT_PROTECTED_RATIO = 0.8
+)
+
+// a segment of a segmented policy, the keys are kept in LRU order with their sizes
+type policySegment struct {
+	list *LinkedHashList[int64]
+	size int64
+}
+
+func newPolicySegment() policySegment {
+	return policySegment{list: NewLinkedHashList[int64]()}
+}
+
+func (segment *policySegment) has(key string) bool {
+	return segment.list.Peek(key) != nil
+}
+
+// add key at the tail, or move it there with the new size
+func (segment *policySegment) push(key string, size int64) {
+	segment.del(key)
+	segment.list.Set(key, size)
+	segment.size += size
+}
+
+// return the size of the removed key, -1 if not in the segment
+func (segment *policySegment) del(key string) int64 {
+	size := segment.list.Del(key)
+	if size == nil {
+		return -1
+	}
+	segment.size -= *size
+	return *size
+}
+
+func (segment *policySegment) front() (string, int64, bool) {
+	key, size := segment.list.Front()
+	if size == nil {
+		return "", 0, false
+	}
+	return key, *size, true
+}
+
+// the first key from the head which is not skipped
+func (segment *policySegment) first(skip func(key string) bool) (string, bool) {
+	return firstKey(segment.list, skip)
+}
+
+func (segment *policySegment) len() int {
+	return segment.list.Len()
+}
+
+// SLRUPolicy is a segmented LRU like 2Q: new entries enter the probation segment and move to the
+// protected one when they are used again, so one-off reads of a scan are evicted before the hot entries
+type SLRUPolicy struct {
+	protectedRatio float64
+	maxProtected   int64
+	probation      policySegment
+	protected      policySegment
+}
+
+// protectedRatio is the share of the max size for the protected segment, 0 is DEFAULT_PROTECTED_RATIO
+func NewSLRUPolicy(protectedRatio float64) *SLRUPolicy {
+	if protectedRatio <= 0 || protectedRatio > 1 {
+		protectedRatio = DEFAULT_PROTECTED_RATIO
+	}
+	return &SLRUPolicy{protectedRatio: protectedRatio, probation: newPolicySegment(), protected: newPolicySegment()}
+}
+
+func (policy *SLRUPolicy) Name() string {
+	return "slru"
+}
+
+func (policy *SLRUPolicy) SetMaxSize(maxSize int64) {
+	policy.maxProtected = int64(float64(maxSize) * policy.protectedRatio)
+	demoteProtected(&policy.protected, &policy.probation, policy.maxProtected)
+}
+
+func (policy *SLRUPolicy) OnInsert(key string, size int64) {
+	if policy.protected.has(key) || policy.probation.has(key) {
+		policy.access(key, size)
+		return
+	}
+	policy.probation.push(key, size)
+}
+
+func (policy *SLRUPolicy) OnAccess(key string) {
+	if size := policy.probation.del(key); size >= 0 {
+		policy.access(key, size)
+	} else if size := policy.protected.del(key); size >= 0 {
+		policy.access(key, size)
+	}
+}
+
+func (policy *SLRUPolicy) access(key string, size int64) {
+	policy.probation.del(key)
+	policy.protected.push(key, size)
+	demoteProtected(&policy.protected, &policy.probation, policy.maxProtected)
+}
+
+func (policy *SLRUPolicy) OnRemove(key string) {
+	if policy.probation.del(key) < 0 {
+		policy.protected.del(key)
+	}
+}
+
+func (policy *SLRUPolicy) Victim(skip func(key string) bool) (string, bool) {
+	if key, ok := policy.probation.first(skip); ok {
+		return key, true
+	}
+	return policy.protected.first(skip)
+}
+
+func (policy *SLRUPolicy) EntryState(key string) string {
+	if policy.protected.has(key) {
+		return "protected"
+	}
+	return ""
+}
+
+func (policy *SLRUPolicy) RestoreEntry(key string, size int64, state string) {
+	policy.OnRemove(key)
+	if state == "protected" {
+		policy.protected.push(key, size)
+		demoteProtected(&policy.protected, &policy.probation, policy.maxProtected)
+	} else {
+		policy.probation.push(key, size)
+	}
+}
+
+// move the least recently used protected keys to the tail of probation until protected fits,
+// the last protected key is kept
+func demoteProtected(protected *policySegment, probation *policySegment, maxProtected int64) {
+	for protected.size > maxProtected && protected.len() > 1 {
+		key, size, _ := protected.front()
+		protected.del(key)
+		probation.push(key, size)
+	}
+}
@@ -0,0 +1,124 @@
+package disklrucache
+
+import (
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the counters of a cache, counters start from 0 when the cache is opened
+type Stats struct {
+	// Get returned a snapshot
+	Hits int64
+	// Get found no readable entry, or the files of the entry can not be opened
+	Misses int64
+	// editors created by Edit and TryEdit
+	Puts    int64
+	Commits int64
+	// editors aborted by Abort or by a failed Commit
+	Aborts int64
+	// entries removed because the cache is full
+	Evictions     int64
+	EvictionBytes int64
+	// entries removed because they are expired
+	Expirations int64
+	// entries removed by Remove
+	Removals int64
+	// entries removed because a value read does not match its checksum
+	Corruptions int64
+	// commits of new entries kept out by Options.Admission
+	Rejections int64
+
+	// bytes of all commited values
+	Size int64
+	// entries in the cache, including the ones never commited
+	Entries int64
+	MaxSize int64
+	// 0 if the entries are not limited
+	MaxEntries int64
+	// bytes and number of entries kept by Pin, the bytes are included in Size
+	PinnedSize    int64
+	PinnedEntries int64
+	// journal records which do not describe a live entry, they are dropped by RebuildJournal
+	RedundantJournalLines int64
+	// readers returned by Get and not closed yet
+	OpenReaders int64
+}
+
+// counters updated without the cache lock
+type cacheStats struct {
+	hits          atomic.Int64
+	misses        atomic.Int64
+	puts          atomic.Int64
+	commits       atomic.Int64
+	aborts        atomic.Int64
+	evictions     atomic.Int64
+	evictionBytes atomic.Int64
+	expirations   atomic.Int64
+	removals      atomic.Int64
+	corruptions   atomic.Int64
+	rejections    atomic.Int64
+	openReaders   atomic.Int64
+}
+
+// get the statistics of the cache, it only holds the read lock to copy the size
+func (cache *DiskLRUCache) Stats() Stats {
+	stats := Stats{
+		Hits:          cache.stats.hits.Load(),
+		Misses:        cache.stats.misses.Load(),
+		Puts:          cache.stats.puts.Load(),
+		Commits:       cache.stats.commits.Load(),
+		Aborts:        cache.stats.aborts.Load(),
+		Evictions:     cache.stats.evictions.Load(),
+		EvictionBytes: cache.stats.evictionBytes.Load(),
+		Expirations:   cache.stats.expirations.Load(),
+		Removals:      cache.stats.removals.Load(),
+		Corruptions:   cache.stats.corruptions.Load(),
+		Rejections:    cache.stats.rejections.Load(),
+		OpenReaders:   cache.stats.openReaders.Load(),
+	}
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	stats.Size = cache.curSize
+	stats.Entries = int64(cache.entries.Len())
+	stats.MaxSize = cache.maxSize
+	stats.MaxEntries = int64(cache.maxEntries)
+	stats.PinnedSize = cache.pinnedSize
+	stats.PinnedEntries = cache.pinnedEntries
+	stats.RedundantJournalLines = cache.redundantJournalLines()
+	return stats
+}
+
+// need lock manually
+func (cache *DiskLRUCache) redundantJournalLines() int64 {
+	redundant := cache.journalRecords - int64(cache.entries.Len())
+	if redundant < 0 {
+		return 0
+	}
+	return redundant
+}
+
+// StatsReader is the reader returned by Get, it is counted as open until closed
+type StatsReader struct {
+	Reader
+	stats  *cacheStats
+	closed atomic.Bool
+}
+
+func newStatsReader(reader Reader, stats *cacheStats) *StatsReader {
+	stats.openReaders.Add(1)
+	return &StatsReader{Reader: reader, stats: stats}
+}
+
+func (r *StatsReader) Close() error {
+	if r.closed.CompareAndSwap(false, true) {
+		r.stats.openReaders.Add(-1)
+	}
+	return r.Reader.Close()
+}
+
+// name of the opened file, it is a link of the value file on windows
+func (r *StatsReader) Name() string {
+	if named, ok := r.Reader.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	return ""
+}
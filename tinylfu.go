@@ -0,0 +1,224 @@
+package disklrucache
+
+import (
+	"fmt"
+	"hash/maphash"
+	"strconv"
+	"strings"
+)
+
+const (
+	// share of the max size kept by the window segment of TinyLFUPolicy
+	DEFAULT_WINDOW_RATIO = 0.01
+	// counters of each row of the frequency sketch
+	SKETCH_WIDTH = 1 << 16
+	// a sketch counter saturates at it
+	SKETCH_MAX_COUNT = 15
+)
+
+// countMinSketch estimates the frequency of keys in a few bytes per key, the counters are halved
+// after 10 increments per counter so old popularity fades
+type countMinSketch struct {
+	seed      maphash.Seed
+	rows      [4][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+// width is rounded up to a power of 2
+func newCountMinSketch(width int) *countMinSketch {
+	size := 1
+	for size < width {
+		size <<= 1
+	}
+	sketch := &countMinSketch{seed: maphash.MakeSeed(), mask: uint64(size - 1), resetAt: 10 * size}
+	for i := range sketch.rows {
+		sketch.rows[i] = make([]uint8, size)
+	}
+	return sketch
+}
+
+// the counter of key in row i, by double hashing
+func (sketch *countMinSketch) index(hash uint64, i int) uint64 {
+	return (hash + uint64(i)*(hash>>32|1)) & sketch.mask
+}
+
+// return true if the counters are halved
+func (sketch *countMinSketch) add(key string) bool {
+	hash := maphash.String(sketch.seed, key)
+	added := false
+	for i := range sketch.rows {
+		counter := &sketch.rows[i][sketch.index(hash, i)]
+		if *counter < SKETCH_MAX_COUNT {
+			*counter++
+			added = true
+		}
+	}
+	if !added {
+		return false
+	}
+	sketch.additions++
+	if sketch.additions < sketch.resetAt {
+		return false
+	}
+	for i := range sketch.rows {
+		for j := range sketch.rows[i] {
+			sketch.rows[i][j] >>= 1
+		}
+	}
+	sketch.additions /= 2
+	return true
+}
+
+func (sketch *countMinSketch) estimate(key string) int {
+	hash := maphash.String(sketch.seed, key)
+	count := uint8(SKETCH_MAX_COUNT)
+	for i := range sketch.rows {
+		count = min(count, sketch.rows[i][sketch.index(hash, i)])
+	}
+	return int(count)
+}
+
+// TinyLFUPolicy is W-TinyLFU: new entries enter a small LRU window, an entry leaving the window
+// is only admitted to the main SLRU segments if its estimated frequency beats the main victim,
+// so a scan passes through the window without flushing the hot entries
+type TinyLFUPolicy struct {
+	windowRatio  float64
+	maxWindow    int64
+	maxMain      int64
+	maxProtected int64
+	window       policySegment
+	probation    policySegment
+	protected    policySegment
+	sketch       *countMinSketch
+}
+
+// windowRatio is the share of the max size for the window, 0 is DEFAULT_WINDOW_RATIO
+func NewTinyLFUPolicy(windowRatio float64) *TinyLFUPolicy {
+	if windowRatio <= 0 || windowRatio >= 1 {
+		windowRatio = DEFAULT_WINDOW_RATIO
+	}
+	return &TinyLFUPolicy{windowRatio: windowRatio, window: newPolicySegment(), probation: newPolicySegment(),
+		protected: newPolicySegment(), sketch: newCountMinSketch(SKETCH_WIDTH)}
+}
+
+func (policy *TinyLFUPolicy) Name() string {
+	return "tinylfu"
+}
+
+func (policy *TinyLFUPolicy) SetMaxSize(maxSize int64) {
+	policy.maxWindow = int64(float64(maxSize) * policy.windowRatio)
+	policy.maxMain = maxSize - policy.maxWindow
+	policy.maxProtected = int64(float64(policy.maxMain) * DEFAULT_PROTECTED_RATIO)
+	demoteProtected(&policy.protected, &policy.probation, policy.maxProtected)
+	policy.admit()
+}
+
+func (policy *TinyLFUPolicy) OnInsert(key string, size int64) {
+	policy.sketch.add(key)
+	if policy.window.has(key) {
+		policy.window.push(key, size)
+	} else if policy.probation.has(key) || policy.protected.has(key) {
+		policy.promote(key, size)
+	} else {
+		policy.window.push(key, size)
+		policy.admit()
+	}
+}
+
+func (policy *TinyLFUPolicy) OnAccess(key string) {
+	policy.sketch.add(key)
+	if size := policy.window.del(key); size >= 0 {
+		policy.window.push(key, size)
+	} else if size := policy.probation.del(key); size >= 0 {
+		policy.promote(key, size)
+	} else if size := policy.protected.del(key); size >= 0 {
+		policy.promote(key, size)
+	}
+}
+
+func (policy *TinyLFUPolicy) promote(key string, size int64) {
+	policy.probation.del(key)
+	policy.protected.push(key, size)
+	demoteProtected(&policy.protected, &policy.probation, policy.maxProtected)
+}
+
+func (policy *TinyLFUPolicy) OnRemove(key string) {
+	if policy.window.del(key) < 0 && policy.probation.del(key) < 0 {
+		policy.protected.del(key)
+	}
+	policy.admit()
+}
+
+// move the keys over the window size to probation while the main segments have room,
+// the rest wait for Victim to compare them with the main victim
+func (policy *TinyLFUPolicy) admit() {
+	for policy.window.size > policy.maxWindow {
+		key, size, _ := policy.window.front()
+		mainSize := policy.probation.size + policy.protected.size
+		if mainSize > 0 && mainSize+size > policy.maxMain {
+			return
+		}
+		policy.window.del(key)
+		policy.probation.push(key, size)
+	}
+}
+
+func (policy *TinyLFUPolicy) mainVictim(skip func(key string) bool) (string, bool) {
+	if key, ok := policy.probation.first(skip); ok {
+		return key, true
+	}
+	return policy.protected.first(skip)
+}
+
+func (policy *TinyLFUPolicy) Victim(skip func(key string) bool) (string, bool) {
+	victim, ok := policy.mainVictim(skip)
+	candidate, hasCandidate := policy.window.first(skip)
+	if !ok {
+		return candidate, hasCandidate
+	}
+	if !hasCandidate || policy.window.size <= policy.maxWindow {
+		return victim, true
+	}
+	// the candidate leaving the window replaces the victim only if it is used more
+	if policy.sketch.estimate(candidate) > policy.sketch.estimate(victim) {
+		return victim, true
+	}
+	return candidate, true
+}
+
+// "segment:frequency"
+func (policy *TinyLFUPolicy) EntryState(key string) string {
+	segment := "window"
+	if policy.probation.has(key) {
+		segment = "probation"
+	} else if policy.protected.has(key) {
+		segment = "protected"
+	}
+	return fmt.Sprintf("%s:%d", segment, policy.sketch.estimate(key))
+}
+
+func (policy *TinyLFUPolicy) RestoreEntry(key string, size int64, state string) {
+	policy.window.del(key)
+	policy.probation.del(key)
+	policy.protected.del(key)
+	segment, count, _ := strings.Cut(state, ":")
+	freq, err := strconv.Atoi(count)
+	if err != nil {
+		freq = 1
+	}
+	for i := 0; i < min(freq, SKETCH_MAX_COUNT); i++ {
+		policy.sketch.add(key)
+	}
+	switch segment {
+	case "probation":
+		policy.probation.push(key, size)
+	case "protected":
+		policy.protected.push(key, size)
+		demoteProtected(&policy.protected, &policy.probation, policy.maxProtected)
+	default:
+		policy.window.push(key, size)
+		policy.admit()
+	}
+}
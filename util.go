@@ -9,11 +9,16 @@ import (
 type EditorWriter struct {
 	file   *os.File
 	editor *DiskLRUCacheEditor
+	index  int
 }
 
 func (w *EditorWriter) Write(p []byte) (n int, err error) {
 	n, err = w.file.Write(p)
 	w.editor.writeSize += int64(n)
+	if hash := w.editor.hashes[w.index]; hash != nil {
+		hash.Write(p[:n])
+		w.editor.hashedSizes[w.index] += int64(n)
+	}
 	return n, err
 }
 
@@ -21,11 +26,17 @@ func (w *EditorWriter) Close() error {
 	return w.file.Close()
 }
 
+// moving away from the end stops hashing while writing, the value is read again by Commit
 func (w *EditorWriter) Seek(offset int64, whence int) (int64, error) {
-	return w.file.Seek(offset, whence)
+	pos, err := w.file.Seek(offset, whence)
+	if err == nil && pos != w.editor.hashedSizes[w.index] {
+		w.editor.hashes[w.index] = nil
+	}
+	return pos, err
 }
 
 func (w *EditorWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	w.editor.hashes[w.index] = nil
 	n, err = w.file.WriteAt(p, off)
 	w.editor.writeSize += int64(n)
 	return n, err
@@ -77,3 +88,21 @@ func renameFile(oldName, newName string, overwrite bool) error {
 	}
 	return os.Rename(oldName, newName)
 }
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// return 0 if file not exist
+func fileSize(name string) int64 {
+	info, err := os.Stat(name)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,241 @@
+package disklrucache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+)
+
+type VerifyOptions struct {
+	// read the values with a checksum to compare it, otherwise only the sizes are checked
+	Checksums bool
+	// remove the broken entries and orphan files, unknown files are deleted if Options.UnknownFiles is
+	// UNKNOWN_FILES_DELETE, then rewrite the journal
+	Repair bool
+}
+
+// Report is the result of Verify, keys and filenames are sorted by LRU order and directory order
+type Report struct {
+	// readable entries checked
+	Entries int
+	// values read to compare their checksums
+	ChecksummedValues int
+	// entries with a value file missing
+	MissingEntries []string
+	// entries with a value file of other size than the journal
+	SizeMismatches []string
+	// entries with a value not matching its checksum
+	ChecksumMismatches []string
+	// tmp files of editors and link files of readers not used any more
+	OrphanFiles []string
+	// files not known by the cache
+	UnknownFiles []string
+	// the size the cache counts and the sum of the entry sizes, they differ if the count is wrong
+	CurSize     int64
+	EntriesSize int64
+	// problems fixed by Repair
+	Repaired int
+}
+
+// return true if nothing is wrong
+func (report *Report) OK() bool {
+	return len(report.MissingEntries) == 0 && len(report.SizeMismatches) == 0 && len(report.ChecksumMismatches) == 0 &&
+		len(report.OrphanFiles) == 0 && len(report.UnknownFiles) == 0 && report.CurSize == report.EntriesSize
+}
+
+// the commited state of an entry copied when Verify starts
+type verifyEntry struct {
+	key      string
+	commitId uint32
+	sizes    []int64
+	checksum ChecksumType
+	sums     [][]byte
+	names    []string
+	problem  *[]string // the list of report the entry is added to, nil if fine
+}
+
+// Verify compares the cache with the files in its directory like fsck, the files are read without the cache lock,
+// so entries changed meanwhile are skipped. ctx stops it early with the report so far
+func (cache *DiskLRUCache) Verify(ctx context.Context, opts VerifyOptions) (Report, error) {
+	report := Report{}
+	if opts.Repair && cache.readOnly {
+		return report, ErrReadOnly
+	}
+	cache.lock.RLock()
+	cache.checkNotClosed()
+	entries := make([]*verifyEntry, 0, cache.entries.Len())
+	iterator := cache.entries.Iterator()
+	for iterator.Next() {
+		entry := iterator.Value()
+		if !entry.readable {
+			continue
+		}
+		checked := &verifyEntry{key: entry.key, commitId: entry.commitId, sizes: entry.sizes,
+			checksum: entry.meta.checksum, sums: entry.meta.sums}
+		for i := 0; i < cache.valueCount; i++ {
+			checked.names = append(checked.names, entry.GetCleanFilenameAt(i))
+		}
+		entries = append(entries, checked)
+	}
+	cache.lock.RUnlock()
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if err := cache.verifyEntry(entry, opts, &report); err != nil {
+			return report, err
+		}
+	}
+	var files []string
+	err := walkCacheFiles(cache.cachePath, 0, func(name string) error {
+		files = append(files, name)
+		return ctx.Err()
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// decide with the current entries, so files and entries changed while reading are not reported
+	cache.lock.Lock()
+	cache.checkNotClosed()
+	known := make(map[string]*CacheEntry)
+	report.CurSize = cache.curSize
+	report.EntriesSize = 0
+	iterator = cache.entries.Iterator()
+	for iterator.Next() {
+		entry := iterator.Value()
+		if entry.readable {
+			report.EntriesSize += entry.size
+		}
+		for i := 0; i < cache.valueCount; i++ {
+			known[entry.GetCleanFilenameAt(i)] = entry
+		}
+	}
+	var broken []*verifyEntry
+	for _, checked := range entries {
+		if checked.problem == nil {
+			continue
+		}
+		if entry := cache.entries.Peek(checked.key); entry != nil && entry.commitId == checked.commitId {
+			*checked.problem = append(*checked.problem, checked.key)
+			broken = append(broken, checked)
+		}
+	}
+	var orphans, unknown []string
+	for _, name := range files {
+		if _, ok := known[name]; ok {
+			continue
+		}
+		if loc := orphanFilePattern.FindStringIndex(name); loc != nil {
+			// the tmp file of a running editor
+			if entry := known[name[:loc[0]]]; entry != nil && entry.curEditor != nil {
+				continue
+			}
+			if _, err := os.Stat(name); err == nil {
+				orphans = append(orphans, name)
+			}
+		} else if _, err := os.Stat(name); err == nil {
+			unknown = append(unknown, name)
+		}
+	}
+	report.OrphanFiles = orphans
+	report.UnknownFiles = unknown
+
+	if !opts.Repair || report.OK() {
+		cache.lock.Unlock()
+		return report, nil
+	}
+	for _, checked := range broken {
+		if checked.problem == &report.ChecksumMismatches {
+			cache.stats.corruptions.Add(1)
+		}
+		cache.removeEntry(checked.key, EVICT_CORRUPT)
+		report.Repaired++
+	}
+	for _, name := range orphans {
+		// a link file still opened by a reader on windows can not be removed
+		if os.Remove(name) == nil {
+			report.Repaired++
+		}
+	}
+	if cache.unknownFiles == UNKNOWN_FILES_DELETE {
+		for _, name := range unknown {
+			if os.Remove(name) == nil {
+				report.Repaired++
+			}
+		}
+	}
+	if report.CurSize != report.EntriesSize {
+		// the broken entries are already subtracted
+		cache.curSize -= report.CurSize - report.EntriesSize
+		report.Repaired++
+		cache.checkFull()
+	}
+	if cache.shardLevels > 0 {
+		removeEmptyShardDirs(cache.cachePath)
+	}
+	cache.unlockAndNotify()
+	if report.Repaired == 0 {
+		// only unknown files which are kept
+		return report, nil
+	}
+	return report, cache.RebuildJournal()
+}
+
+// check the files of an entry, a problem is marked on entry, errors other than a missing file are returned
+func (cache *DiskLRUCache) verifyEntry(entry *verifyEntry, opts VerifyOptions, report *Report) error {
+	report.Entries++
+	for i, name := range entry.names {
+		info, err := os.Stat(name)
+		if os.IsNotExist(err) {
+			entry.problem = &report.MissingEntries
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if i < len(entry.sizes) && info.Size() != entry.sizes[i] {
+			entry.problem = &report.SizeMismatches
+			return nil
+		}
+	}
+	if !opts.Checksums || entry.checksum == CHECKSUM_NONE {
+		return nil
+	}
+	for i, name := range entry.names {
+		if i >= len(entry.sums) {
+			break
+		}
+		sum, err := readerChecksum(entry.checksum, name)
+		if os.IsNotExist(err) {
+			// replaced or removed meanwhile, the commit id tells
+			entry.problem = &report.MissingEntries
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		report.ChecksummedValues++
+		if !bytes.Equal(sum, entry.sums[i]) {
+			entry.problem = &report.ChecksumMismatches
+			return nil
+		}
+	}
+	return nil
+}
+
+// like fileChecksum, but open the value the way Get does, so it does not block writers on windows
+func readerChecksum(checksum ChecksumType, name string) ([]byte, error) {
+	reader, err := openReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	hash := checksum.newHash()
+	if _, err := io.Copy(hash, reader); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}